@@ -0,0 +1,313 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package etree
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// xmlNamespaceURI is the namespace URI permanently bound to the "xml"
+// prefix.
+const xmlNamespaceURI = "http://www.w3.org/XML/1998/namespace"
+
+// C14NSettings determine the behavior of the Element's and Document's
+// canonicalization functions.
+type C14NSettings struct {
+	// Exclusive selects Exclusive XML Canonicalization 1.0, which renders
+	// only the namespace declarations visibly used by each element and its
+	// attributes. If false, Canonical XML 1.0 is used, which renders all
+	// namespace declarations in scope. Default: false.
+	Exclusive bool
+
+	// WithComments causes comments to be included in the canonical form.
+	// Default: false.
+	WithComments bool
+
+	// InclusiveNamespaces is the InclusiveNamespaces PrefixList of
+	// Exclusive XML Canonicalization: the namespace prefixes whose
+	// declarations are rendered according to the rules of Canonical XML
+	// 1.0, whether or not they are visibly used. The prefix "#default"
+	// denotes the default namespace. Ignored unless Exclusive is true.
+	// Default: nil.
+	InclusiveNamespaces []string
+}
+
+// WriteCanonical serializes the element and its descendants to the writer
+// 'w' in the canonical form defined by the W3C Canonical XML 1.0 or
+// Exclusive XML Canonicalization 1.0 recommendations. Called on a document,
+// it canonicalizes the whole document, omitting its XML declaration and
+// document type declaration. Called on any other element, it canonicalizes
+// the element's subtree, taking into account the namespace declarations
+// (and, for inclusive canonicalization, the xml:* attributes) inherited
+// from the element's ancestors. If 's' is nil, inclusive canonicalization
+// without comments is used. The function returns the number of bytes
+// written and any error encountered.
+func (e *Element) WriteCanonical(w io.Writer, s *C14NSettings) (n int64, err error) {
+	if s == nil {
+		s = &C14NSettings{}
+	}
+
+	xw := newXmlWriter(w)
+	b := bufio.NewWriter(xw)
+	c := newCanonicalizer(b, s)
+	if e.parent == nil && e.Tag == "" {
+		c.writeDocument(e)
+	} else {
+		c.writeApex(e)
+	}
+	err, n = b.Flush(), xw.bytes
+	return
+}
+
+// CanonicalBytes returns the canonical form of the element and its
+// descendants, as written by WriteCanonical.
+func (e *Element) CanonicalBytes(s *C14NSettings) []byte {
+	var buf bytes.Buffer
+	e.WriteCanonical(&buf, s)
+	return buf.Bytes()
+}
+
+// A canonicalizer writes element trees in canonical form.
+type canonicalizer struct {
+	w         Writer
+	exclusive bool
+	comments  bool
+	prefixes  []string // inclusive prefixes; "" is the default namespace
+}
+
+func newCanonicalizer(w Writer, s *C14NSettings) *canonicalizer {
+	c := &canonicalizer{
+		w:         w,
+		exclusive: s.Exclusive,
+		comments:  s.WithComments,
+	}
+	if s.Exclusive {
+		for _, p := range s.InclusiveNamespaces {
+			if p == "#default" {
+				p = ""
+			}
+			c.prefixes = append(c.prefixes, p)
+		}
+	}
+	return c
+}
+
+// writeDocument writes the children of a document's embedded element.
+// Character data and directives outside the root element are dropped, and
+// comments and processing instructions are separated from the root element
+// by line feeds.
+func (c *canonicalizer) writeDocument(d *Element) {
+	afterRoot := false
+	for _, t := range d.Child {
+		switch t := t.(type) {
+		case *Element:
+			c.writeElement(t, nil, nil, nil)
+			afterRoot = true
+		case *Comment:
+			if c.comments {
+				c.writeOutside(t, afterRoot)
+			}
+		case *ProcInst:
+			if t.Target != "xml" {
+				c.writeOutside(t, afterRoot)
+			}
+		}
+	}
+}
+
+// writeOutside writes a token found outside the document's root element.
+func (c *canonicalizer) writeOutside(t Token, afterRoot bool) {
+	if afterRoot {
+		c.w.WriteByte('\n')
+	}
+	t.WriteTo(c.w, &WriteSettings{})
+	if !afterRoot {
+		c.w.WriteByte('\n')
+	}
+}
+
+// writeApex writes the element at the top of a canonicalized subtree,
+// which inherits the namespaces declared by its ancestors.
+func (c *canonicalizer) writeApex(e *Element) {
+	var ancestors []*Element
+	for a := e.parent; a != nil; a = a.parent {
+		ancestors = append(ancestors, a)
+	}
+
+	var inScope map[string]string
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		inScope = declareNamespaces(inScope, ancestors[i])
+	}
+
+	// Canonical XML 1.0 also renders the xml:* attributes inherited from
+	// omitted ancestors, unless the element overrides them.
+	var inherited []Attr
+	if !c.exclusive {
+		seen := make(map[string]bool)
+		for _, a := range e.Attr {
+			if a.Space == "xml" {
+				seen[a.Key] = true
+			}
+		}
+		for _, anc := range ancestors {
+			for _, a := range anc.Attr {
+				if a.Space == "xml" && !seen[a.Key] {
+					seen[a.Key] = true
+					inherited = append(inherited, a)
+				}
+			}
+		}
+	}
+
+	c.writeElement(e, inScope, nil, inherited)
+}
+
+// writeElement writes the element e and its descendants. The 'inScope' map
+// holds the namespaces in scope at the element's parent, and 'rendered'
+// holds the namespace declarations rendered by the element's output
+// ancestors. Both maps are keyed by prefix, with "" denoting the default
+// namespace.
+func (c *canonicalizer) writeElement(e *Element, inScope, rendered map[string]string, inherited []Attr) {
+	inScope = declareNamespaces(inScope, e)
+
+	// Choose the namespace declarations to render.
+	var candidates []string
+	if c.exclusive {
+		candidates = append(candidates, e.Space)
+		for _, a := range e.Attr {
+			if a.Space != "" && a.Space != "xmlns" {
+				candidates = append(candidates, a.Space)
+			}
+		}
+		candidates = append(candidates, c.prefixes...)
+	} else {
+		for p := range inScope {
+			candidates = append(candidates, p)
+		}
+	}
+	slices.Sort(candidates)
+	candidates = slices.Compact(candidates)
+
+	var decls []string
+	for _, p := range candidates {
+		uri, ok := inScope[p]
+		if p == "xml" || (!ok && p != "") {
+			continue
+		}
+		if have, ok := rendered[p]; (ok || p == "") && have == uri {
+			continue
+		}
+		decls = append(decls, p)
+	}
+	if len(decls) > 0 {
+		rendered = maps.Clone(rendered)
+		if rendered == nil {
+			rendered = make(map[string]string)
+		}
+		for _, p := range decls {
+			rendered[p] = inScope[p]
+		}
+	}
+
+	// Sort the attributes by namespace URI and then by local name.
+	var attrs []Attr
+	for _, a := range e.Attr {
+		if a.Space != "xmlns" && !(a.Space == "" && a.Key == "xmlns") {
+			attrs = append(attrs, a)
+		}
+	}
+	attrs = append(attrs, inherited...)
+	slices.SortFunc(attrs, func(a, b Attr) int {
+		if v := strings.Compare(attrNamespaceURI(a, inScope), attrNamespaceURI(b, inScope)); v != 0 {
+			return v
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	c.w.WriteByte('<')
+	c.w.WriteString(e.FullTag())
+	for _, p := range decls {
+		c.w.WriteString(" xmlns")
+		if p != "" {
+			c.w.WriteByte(':')
+			c.w.WriteString(p)
+		}
+		c.w.WriteString(`="`)
+		escapeString(c.w, inScope[p], escapeCanonicalAttr)
+		c.w.WriteByte('"')
+	}
+	for _, a := range attrs {
+		c.w.WriteByte(' ')
+		c.w.WriteString(a.FullKey())
+		c.w.WriteString(`="`)
+		escapeString(c.w, a.Value, escapeCanonicalAttr)
+		c.w.WriteByte('"')
+	}
+	c.w.WriteByte('>')
+
+	for _, t := range e.Child {
+		switch t := t.(type) {
+		case *Element:
+			c.writeElement(t, inScope, rendered, nil)
+		case *CharData:
+			escapeString(c.w, t.Data, escapeCanonicalText)
+		case *Comment:
+			if c.comments {
+				t.WriteTo(c.w, &WriteSettings{})
+			}
+		case *ProcInst:
+			t.WriteTo(c.w, &WriteSettings{})
+		}
+	}
+
+	c.w.WriteString("</")
+	c.w.WriteString(e.FullTag())
+	c.w.WriteByte('>')
+}
+
+// declareNamespaces returns the namespaces in scope at the element e, given
+// the namespaces in scope at its parent. The parent's map is copied only if
+// the element declares namespaces of its own.
+func declareNamespaces(inScope map[string]string, e *Element) map[string]string {
+	copied := false
+	for _, a := range e.Attr {
+		var prefix string
+		switch {
+		case a.Space == "xmlns":
+			prefix = a.Key
+		case a.Space == "" && a.Key == "xmlns":
+			prefix = ""
+		default:
+			continue
+		}
+		if !copied {
+			inScope = maps.Clone(inScope)
+			if inScope == nil {
+				inScope = make(map[string]string)
+			}
+			copied = true
+		}
+		inScope[prefix] = a.Value
+	}
+	return inScope
+}
+
+// attrNamespaceURI returns the namespace URI of the attribute a, given the
+// namespaces in scope at its element.
+func attrNamespaceURI(a Attr, inScope map[string]string) string {
+	switch a.Space {
+	case "":
+		return ""
+	case "xml":
+		return xmlNamespaceURI
+	default:
+		return inScope[a.Space]
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package etree
+
+import "testing"
+
+func TestCanonicalizeDocument(t *testing.T) {
+	s := `<?xml version="1.0"?>
+
+<?xml-stylesheet   href="doc.xsl"
+   type="text/xsl"   ?>
+
+<!DOCTYPE doc SYSTEM "doc.dtd">
+
+<doc>Hello, world!<!-- Comment 1 --></doc>
+
+<?pi-without-data     ?>
+
+<!-- Comment 2 -->
+
+<!-- Comment 3 -->
+`
+	doc := newDocumentFromString(t, s)
+
+	checkStrEq(t, string(doc.CanonicalBytes(nil)), `<?xml-stylesheet href="doc.xsl"
+   type="text/xsl"   ?>
+<doc>Hello, world!</doc>
+<?pi-without-data?>`)
+
+	checkStrEq(t, string(doc.CanonicalBytes(&C14NSettings{WithComments: true})), `<?xml-stylesheet href="doc.xsl"
+   type="text/xsl"   ?>
+<doc>Hello, world!<!-- Comment 1 --></doc>
+<?pi-without-data?>
+<!-- Comment 2 -->
+<!-- Comment 3 -->`)
+}
+
+func TestCanonicalizeTags(t *testing.T) {
+	s := `<doc>
+   <e1   />
+   <e2   ></e2>
+   <e3   name = "elem3"   id="elem3"   />
+   <e4   name="elem4"   id="elem4"   ></e4>
+   <e5 a:attr="out" b:attr="sorted" attr2="all" attr="I'm"
+      xmlns:b="http://www.ietf.org"
+      xmlns:a="http://www.w3.org"
+      xmlns="http://example.org"/>
+   <e6 xmlns="" xmlns:a="http://www.w3.org">
+      <e7 xmlns="http://www.ietf.org">
+         <e8 xmlns="" xmlns:a="http://www.w3.org">
+            <e9 xmlns="" xmlns:a="http://www.ietf.org"/>
+         </e8>
+      </e7>
+   </e6>
+</doc>`
+	doc := newDocumentFromString(t, s)
+
+	checkStrEq(t, string(doc.CanonicalBytes(nil)), `<doc>
+   <e1></e1>
+   <e2></e2>
+   <e3 id="elem3" name="elem3"></e3>
+   <e4 id="elem4" name="elem4"></e4>
+   <e5 xmlns="http://example.org" xmlns:a="http://www.w3.org" xmlns:b="http://www.ietf.org" attr="I'm" attr2="all" b:attr="sorted" a:attr="out"></e5>
+   <e6 xmlns:a="http://www.w3.org">
+      <e7 xmlns="http://www.ietf.org">
+         <e8 xmlns="">
+            <e9 xmlns:a="http://www.ietf.org"></e9>
+         </e8>
+      </e7>
+   </e6>
+</doc>`)
+
+	checkStrEq(t, string(doc.CanonicalBytes(&C14NSettings{Exclusive: true})), `<doc>
+   <e1></e1>
+   <e2></e2>
+   <e3 id="elem3" name="elem3"></e3>
+   <e4 id="elem4" name="elem4"></e4>
+   <e5 xmlns="http://example.org" xmlns:a="http://www.w3.org" xmlns:b="http://www.ietf.org" attr="I'm" attr2="all" b:attr="sorted" a:attr="out"></e5>
+   <e6>
+      <e7 xmlns="http://www.ietf.org">
+         <e8 xmlns="">
+            <e9></e9>
+         </e8>
+      </e7>
+   </e6>
+</doc>`)
+}
+
+func TestCanonicalizeText(t *testing.T) {
+	s := `<doc>
+   <text>First line&#x0d;&#10;Second line</text>
+   <value>&#x32;</value>
+   <compute><![CDATA[value>"0" && value<"10" ?"valid":"error"]]></compute>
+   <norm attr=' &apos;   &#x20;&#13;&#xa;&#9;   &apos; '/>
+</doc>`
+	doc := newDocumentFromString(t, s)
+
+	checkStrEq(t, string(doc.CanonicalBytes(nil)), `<doc>
+   <text>First line&#xD;
+Second line</text>
+   <value>2</value>
+   <compute>value&gt;"0" &amp;&amp; value&lt;"10" ?"valid":"error"</compute>
+   <norm attr=" '    &#xD;&#xA;&#x9;   ' "></norm>
+</doc>`)
+}
+
+func TestCanonicalizeSubtree(t *testing.T) {
+	s1 := `<n0:local xmlns:n0="foo:bar" xmlns:n3="ftp://example.org">
+  <n1:elem2 xmlns:n1="http://example.net" xml:lang="en">
+    <n3:stuff xmlns:n3="ftp://example.org"/>
+  </n1:elem2>
+</n0:local>`
+	s2 := `<n2:pdu xmlns:n1="http://example.com" xmlns:n2="http://foo.example" xml:lang="fr" xml:space="retain">
+  <n1:elem2 xmlns:n1="http://example.net" xml:lang="en">
+    <n3:stuff xmlns:n3="ftp://example.org"/>
+  </n1:elem2>
+</n2:pdu>`
+
+	cases := []struct {
+		doc      string
+		settings C14NSettings
+		want     string
+	}{
+		{s1, C14NSettings{}, `<n1:elem2 xmlns:n0="foo:bar" xmlns:n1="http://example.net" xmlns:n3="ftp://example.org" xml:lang="en">
+    <n3:stuff></n3:stuff>
+  </n1:elem2>`},
+		{s2, C14NSettings{}, `<n1:elem2 xmlns:n1="http://example.net" xmlns:n2="http://foo.example" xml:lang="en" xml:space="retain">
+    <n3:stuff xmlns:n3="ftp://example.org"></n3:stuff>
+  </n1:elem2>`},
+		{s1, C14NSettings{Exclusive: true}, `<n1:elem2 xmlns:n1="http://example.net" xml:lang="en">
+    <n3:stuff xmlns:n3="ftp://example.org"></n3:stuff>
+  </n1:elem2>`},
+		{s2, C14NSettings{Exclusive: true}, `<n1:elem2 xmlns:n1="http://example.net" xml:lang="en">
+    <n3:stuff xmlns:n3="ftp://example.org"></n3:stuff>
+  </n1:elem2>`},
+		{s2, C14NSettings{Exclusive: true, InclusiveNamespaces: []string{"n2", "n3", "bogus"}}, `<n1:elem2 xmlns:n1="http://example.net" xmlns:n2="http://foo.example" xml:lang="en">
+    <n3:stuff xmlns:n3="ftp://example.org"></n3:stuff>
+  </n1:elem2>`},
+	}
+	for _, c := range cases {
+		doc := newDocumentFromString(t, c.doc)
+		e := doc.FindElement("//elem2")
+		checkStrEq(t, string(e.CanonicalBytes(&c.settings)), c.want)
+	}
+}
+
+func TestCanonicalizeDefaultNamespace(t *testing.T) {
+	s := `<root xmlns="urn:a"><x:a xmlns:x="urn:x"><b/></x:a></root>`
+	doc := newDocumentFromString(t, s)
+	a := doc.FindElement("//a")
+
+	checkStrEq(t, string(a.CanonicalBytes(&C14NSettings{Exclusive: true})),
+		`<x:a xmlns:x="urn:x"><b xmlns="urn:a"></b></x:a>`)
+	checkStrEq(t, string(a.CanonicalBytes(&C14NSettings{Exclusive: true, InclusiveNamespaces: []string{"#default"}})),
+		`<x:a xmlns="urn:a" xmlns:x="urn:x"><b></b></x:a>`)
+	checkStrEq(t, string(a.CanonicalBytes(nil)),
+		`<x:a xmlns="urn:a" xmlns:x="urn:x"><b></b></x:a>`)
+}
@@ -0,0 +1,122 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package etree
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+	"unicode/utf16"
+)
+
+func TestSingleByteCharsets(t *testing.T) {
+	cases := []struct {
+		charset, in, want string
+	}{
+		{"ISO-8859-1", "cr\xe8me br\xfbl\xe9e", "crème brûlée"},
+		{"latin1", "\xa9 \xff", "© ÿ"},
+		{"ISO-8859-2", "\xa3\xf3d\xbc", "Łódź"},
+		{"ISO-8859-5", "\xbc\xde\xe1\xda\xd2\xd0", "Москва"},
+		{"ISO-8859-7", "\xe1\xe2\xe3", "αβγ"},
+		{"ISO-8859-15", "5\xa4", "5€"},
+		{"windows-1250", "\x8a\x9a", "Šš"},
+		{"Windows-1251", "\xcf\xf0\xe8\xe2\xe5\xf2", "Привет"},
+		{"windows-1252", "\x93\x80\x94 \x81", "“€” �"},
+		{"cp1254", "\xd0\xfe", "Ğş"},
+		{"US-ASCII", "caf\xe9", "caf�"},
+	}
+	for _, c := range cases {
+		s := `<?xml version="1.0" encoding="` + c.charset + `"?><a b="` + c.in + `">` + c.in + `</a>`
+		doc := newDocumentFromString2(t, s, ReadSettings{CharsetReader: NewCharsetReader})
+		checkStrEq(t, doc.Root().Text(), c.want)
+		checkStrEq(t, doc.Root().SelectAttrValue("b", ""), c.want)
+	}
+}
+
+func TestCharsetReaderSettings(t *testing.T) {
+	s := `<?xml version="1.0" encoding="x-unknown"?><a>café</a>`
+
+	// The default reader passes unsupported charsets through.
+	doc := newDocumentFromString(t, s)
+	checkStrEq(t, doc.Root().Text(), "café")
+
+	// It passes declared charsets through too, so that documents whose
+	// declaration is wrong are not converted twice.
+	doc = newDocumentFromString(t, `<?xml version="1.0" encoding="ISO-8859-1"?><a>café</a>`)
+	checkStrEq(t, doc.Root().Text(), "café")
+
+	// NewCharsetReader rejects unsupported charsets.
+	doc = NewDocument()
+	doc.ReadSettings.CharsetReader = NewCharsetReader
+	if err := doc.ReadFromString(s); err == nil {
+		t.Error("etree: expected an error reading an unsupported charset")
+	}
+}
+
+// encodeUTF16 encodes the string 's' as UTF-16 with the specified byte
+// order, optionally preceded by a byte order mark.
+func encodeUTF16(s string, bigEndian, bom bool) []byte {
+	units := utf16.Encode([]rune(s))
+	if bom {
+		units = append([]uint16{0xfeff}, units...)
+	}
+	var b []byte
+	for _, u := range units {
+		if bigEndian {
+			b = append(b, byte(u>>8), byte(u))
+		} else {
+			b = append(b, byte(u), byte(u>>8))
+		}
+	}
+	return b
+}
+
+func TestUTF16(t *testing.T) {
+	s := `<?xml version="1.0" encoding="UTF-16"?><a b="😀">crème €</a>`
+	cases := []struct {
+		bigEndian, bom bool
+	}{
+		{true, true},
+		{false, true},
+		{true, false},
+		{false, false},
+	}
+	for _, c := range cases {
+		b := encodeUTF16(s, c.bigEndian, c.bom)
+		for _, validate := range []bool{false, true} {
+			doc := NewDocument()
+			doc.ReadSettings.ValidateInput = validate
+			doc.ReadSettings.CharsetReader = NewCharsetReader
+			if err := doc.ReadFromBytes(b); err != nil {
+				t.Fatal(err)
+			}
+			checkStrEq(t, doc.Root().Text(), "crème €")
+			checkStrEq(t, doc.Root().SelectAttrValue("b", ""), "😀")
+		}
+
+		// Code units and surrogate pairs split across reads are decoded.
+		doc := NewDocument()
+		n, err := doc.ReadFrom(iotest.OneByteReader(bytes.NewReader(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIntEq(t, int(n), len(b))
+		checkStrEq(t, doc.Root().SelectAttrValue("b", ""), "😀")
+	}
+
+	// Unpaired surrogates and odd trailing bytes are replaced.
+	b := append(encodeUTF16("<a>x", false, true), 0x00, 0xd8, 'y', 0x00)
+	b = append(b, encodeUTF16("</a>", false, false)...)
+	r, err := NewCharsetReader("utf-16", bytes.NewReader(append(b, 'z')))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, string(out), "<a>x�y</a>�")
+}
@@ -0,0 +1,641 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package etree
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+A Selector is a compiled CSS selector used to locate elements within an
+element tree. Selectors are used with the Element object's QuerySelector and
+QuerySelectorAll methods, and provide an alternative to etree paths for those
+more familiar with CSS than with XPath.
+
+A selector consists of one or more comma-separated complex selectors. Each
+complex selector is a series of compound selectors joined by combinators,
+and each compound selector is a series of simple selectors that an element
+must all match. The following simple selectors are supported:
+
+	tag                 Elements with a name matching the tag.
+	*                   Any element.
+	#id                 Elements with an 'id' attribute matching id.
+	.class              Elements whose whitespace-separated 'class' attribute
+	                    contains class.
+	[attr]              Elements with an attribute named attr.
+	[attr=val]          Elements whose attr attribute is exactly val.
+	[attr~=val]         Elements whose attr attribute is a whitespace-separated
+	                    list containing val.
+	[attr|=val]         Elements whose attr attribute is val or starts with
+	                    val followed by '-'.
+	[attr^=val]         Elements whose attr attribute starts with val.
+	[attr$=val]         Elements whose attr attribute ends with val.
+	[attr*=val]         Elements whose attr attribute contains val.
+	:root               The root element of the document.
+	:empty              Elements without child elements or text.
+	:first-child        Elements that are the first child element of their
+	                    parent.
+	:last-child         Elements that are the last child element of their
+	                    parent.
+	:only-child         Elements that are their parent's only child element.
+	:nth-child(an+b)    Elements that are the (an+b)-th child element of their
+	                    parent for some n >= 0. The argument may also be 'odd'
+	                    or 'even'.
+	:nth-last-child(an+b)
+	                    As :nth-child, counting from the last child element.
+	:not(selectors)     Elements not matching any of the selectors.
+
+Attribute values may be quoted with single or double quotes. As with etree
+paths, tag and attribute names without a namespace prefix match elements and
+attributes having any prefix. Because the colon introduces a pseudo-class, the
+colon separating a namespace prefix from a name must be escaped with a
+backslash, as in 'p\:price'.
+
+The following combinators are supported:
+
+	a b                 Elements matching b that are descendants of an element
+	                    matching a.
+	a > b               Elements matching b that are children of an element
+	                    matching a.
+	a + b               Elements matching b that immediately follow a sibling
+	                    element matching a.
+	a ~ b               Elements matching b that follow a sibling element
+	                    matching a.
+
+As in the DOM, a query selects only elements descended from the element at
+which it starts, but the ancestors and siblings of that element may be used to
+satisfy the selector's combinators.
+*/
+type Selector struct {
+	list []cssComplex
+}
+
+// ErrSelector is returned by selector functions when an invalid CSS selector
+// is provided.
+type ErrSelector string
+
+// Error returns the string describing a selector error.
+func (err ErrSelector) Error() string {
+	return "etree: " + string(err)
+}
+
+// CompileSelector creates a compiled version of a CSS selector string that
+// can be used to query elements in an element tree.
+func CompileSelector(selector string) (Selector, error) {
+	c := cssCompiler{s: selector}
+	list := c.parseList()
+	if c.err == ErrSelector("") && c.pos < len(c.s) {
+		c.unexpected()
+	}
+	if c.err != ErrSelector("") {
+		return Selector{}, c.err
+	}
+	return Selector{list}, nil
+}
+
+// MustCompileSelector creates a compiled version of a CSS selector string.
+// Panics if an error occurs. Use this function to create Selectors when you
+// know the selector is valid (i.e., if it's hard-coded).
+func MustCompileSelector(selector string) Selector {
+	s, err := CompileSelector(selector)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Matches returns true if the element 'e' matches the selector.
+func (s Selector) Matches(e *Element) bool {
+	return cssMatchList(s.list, e)
+}
+
+// First returns the first element, in document order, descended from the
+// element 'e' and matching the selector. It returns nil if no element
+// matches.
+func (s Selector) First(e *Element) *Element {
+	var found *Element
+	s.walk(e, func(c *Element) bool {
+		found = c
+		return false
+	})
+	return found
+}
+
+// All returns all elements, in document order, descended from the element
+// 'e' and matching the selector.
+func (s Selector) All(e *Element) []*Element {
+	var elements []*Element
+	s.walk(e, func(c *Element) bool {
+		elements = append(elements, c)
+		return true
+	})
+	return elements
+}
+
+// walk calls the visit function, in document order, for each element
+// descended from the element 'e' and matching the selector. The walk ends
+// early if visit returns false.
+func (s Selector) walk(e *Element, visit func(e *Element) bool) bool {
+	for _, c := range e.ChildElements() {
+		if s.Matches(c) && !visit(c) {
+			return false
+		}
+		if !s.walk(c, visit) {
+			return false
+		}
+	}
+	return true
+}
+
+// QuerySelector returns the first element, in document order, descended from
+// this element and matching the CSS 'selector' string. The function returns
+// nil if no element matches. It panics if an invalid selector string is
+// supplied.
+func (e *Element) QuerySelector(selector string) *Element {
+	return MustCompileSelector(selector).First(e)
+}
+
+// QuerySelectorAll returns all elements, in document order, descended from
+// this element and matching the CSS 'selector' string. It panics if an
+// invalid selector string is supplied.
+func (e *Element) QuerySelectorAll(selector string) []*Element {
+	return MustCompileSelector(selector).All(e)
+}
+
+// A cssComplex is a series of compound selectors joined by combinators.
+type cssComplex struct {
+	compounds   []cssCompound
+	combinators []byte // combinators[i] joins compounds[i] and compounds[i+1]
+}
+
+// cssMatchList returns true if the element matches any of the complex
+// selectors in the list.
+func cssMatchList(list []cssComplex, e *Element) bool {
+	for i := range list {
+		if list[i].matches(e, len(list[i].compounds)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the element matches the complex selector's
+// compound selectors up to and including compounds[i]. Matching proceeds
+// from right to left.
+func (c *cssComplex) matches(e *Element, i int) bool {
+	if !c.compounds[i].matches(e) {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+
+	switch c.combinators[i-1] {
+	case '>':
+		return e.parent != nil && c.matches(e.parent, i-1)
+	case '+':
+		s := e.PrevSibling()
+		return s != nil && c.matches(s, i-1)
+	case '~':
+		for s := e.PrevSibling(); s != nil; s = s.PrevSibling() {
+			if c.matches(s, i-1) {
+				return true
+			}
+		}
+	default:
+		for a := e.parent; a != nil; a = a.parent {
+			if c.matches(a, i-1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A cssCompound is a series of simple selectors that an element must all
+// match.
+type cssCompound struct {
+	space, tag string // tag is "*" if any tag matches
+	conds      []cssCond
+}
+
+func (c *cssCompound) matches(e *Element) bool {
+	// The document's element is never matched.
+	if e.Tag == "" || !spaceMatch(c.space, e.Space) || (c.tag != "*" && c.tag != e.Tag) {
+		return false
+	}
+	for _, cond := range c.conds {
+		if !cond.matches(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// A cssCond is a simple selector other than a type selector.
+type cssCond interface {
+	matches(e *Element) bool
+}
+
+// cssAttr matches elements having an attribute whose value satisfies an
+// operator. An empty operator matches any value.
+type cssAttr struct {
+	space, key string
+	op, val    string
+}
+
+func (c *cssAttr) matches(e *Element) bool {
+	for _, a := range e.Attr {
+		if spaceMatch(c.space, a.Space) && c.key == a.Key && c.test(a.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cssAttr) test(v string) bool {
+	switch c.op {
+	case "":
+		return true
+	case "=":
+		return v == c.val
+	case "~=":
+		for _, f := range strings.Fields(v) {
+			if f == c.val {
+				return true
+			}
+		}
+		return false
+	case "|=":
+		return v == c.val || strings.HasPrefix(v, c.val+"-")
+	case "^=":
+		return c.val != "" && strings.HasPrefix(v, c.val)
+	case "$=":
+		return c.val != "" && strings.HasSuffix(v, c.val)
+	default:
+		return c.val != "" && strings.Contains(v, c.val)
+	}
+}
+
+// cssNth matches elements whose 1-based position among their parent's child
+// elements is a*n+b for some n >= 0. If last is true, positions are counted
+// from the last child element.
+type cssNth struct {
+	a, b int
+	last bool
+}
+
+func (c *cssNth) matches(e *Element) bool {
+	if e.parent == nil {
+		return false
+	}
+	pos := 1
+	if c.last {
+		for s := e.NextSibling(); s != nil; s = s.NextSibling() {
+			pos++
+		}
+	} else {
+		for s := e.PrevSibling(); s != nil; s = s.PrevSibling() {
+			pos++
+		}
+	}
+	if c.a == 0 {
+		return pos == c.b
+	}
+	n := pos - c.b
+	return n%c.a == 0 && n/c.a >= 0
+}
+
+// cssOnlyChild matches elements that are their parent's only child element.
+type cssOnlyChild struct{}
+
+func (c *cssOnlyChild) matches(e *Element) bool {
+	return e.parent != nil && e.PrevSibling() == nil && e.NextSibling() == nil
+}
+
+// cssRoot matches the root element of a document.
+type cssRoot struct{}
+
+func (c *cssRoot) matches(e *Element) bool {
+	return e.parent == nil || (e.parent.parent == nil && e.parent.Tag == "")
+}
+
+// cssEmpty matches elements without child elements or text.
+type cssEmpty struct{}
+
+func (c *cssEmpty) matches(e *Element) bool {
+	for _, t := range e.Child {
+		switch t := t.(type) {
+		case *Element:
+			return false
+		case *CharData:
+			if t.Data != "" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// cssNot matches elements not matching any of a list of selectors.
+type cssNot struct {
+	list []cssComplex
+}
+
+func (c *cssNot) matches(e *Element) bool {
+	return !cssMatchList(c.list, e)
+}
+
+// A cssCompiler generates a compiled selector from a CSS selector string.
+type cssCompiler struct {
+	err ErrSelector
+	s   string
+	pos int
+}
+
+// parseList parses a comma-separated list of complex selectors.
+func (c *cssCompiler) parseList() []cssComplex {
+	var list []cssComplex
+	for {
+		c.skipSpace()
+		list = append(list, c.parseComplex())
+		c.skipSpace()
+		if c.err != ErrSelector("") || !c.peek(',') {
+			return list
+		}
+		c.pos++
+	}
+}
+
+// parseComplex parses a series of compound selectors joined by combinators.
+func (c *cssCompiler) parseComplex() cssComplex {
+	var cx cssComplex
+	for {
+		cx.compounds = append(cx.compounds, c.parseCompound())
+		if c.err != ErrSelector("") {
+			return cx
+		}
+
+		space := c.skipSpace() > 0
+		switch {
+		case c.peek('>') || c.peek('+') || c.peek('~'):
+			cx.combinators = append(cx.combinators, c.s[c.pos])
+			c.pos++
+			c.skipSpace()
+		case space && c.pos < len(c.s) && !c.peek(',') && !c.peek(')'):
+			cx.combinators = append(cx.combinators, ' ')
+		default:
+			return cx
+		}
+	}
+}
+
+// parseCompound parses a series of simple selectors.
+func (c *cssCompiler) parseCompound() cssCompound {
+	cp := cssCompound{tag: "*"}
+	start := c.pos
+	switch {
+	case c.peek('*'):
+		c.pos++
+	case c.peekName():
+		cp.space, cp.tag = spaceDecompose(c.parseName())
+	}
+
+	for c.err == ErrSelector("") && c.pos < len(c.s) {
+		switch c.s[c.pos] {
+		case '#':
+			c.pos++
+			cp.conds = append(cp.conds, &cssAttr{key: "id", op: "=", val: c.parseRequiredName()})
+		case '.':
+			c.pos++
+			cp.conds = append(cp.conds, &cssAttr{key: "class", op: "~=", val: c.parseRequiredName()})
+		case '[':
+			cp.conds = append(cp.conds, c.parseAttr())
+		case ':':
+			cp.conds = append(cp.conds, c.parsePseudo())
+		default:
+			if c.pos == start {
+				c.unexpected()
+			}
+			return cp
+		}
+	}
+	if c.err == ErrSelector("") && c.pos == start {
+		c.unexpected()
+	}
+	return cp
+}
+
+// parseAttr parses an attribute selector in [brackets].
+func (c *cssCompiler) parseAttr() cssCond {
+	c.pos++
+	c.skipSpace()
+	space, key := spaceDecompose(c.parseRequiredName())
+	a := &cssAttr{space: space, key: key}
+	c.skipSpace()
+	for _, op := range []string{"=", "~=", "|=", "^=", "$=", "*="} {
+		if strings.HasPrefix(c.s[c.pos:], op) {
+			c.pos += len(op)
+			c.skipSpace()
+			a.op, a.val = op, c.parseValue()
+			c.skipSpace()
+			break
+		}
+	}
+	if c.err == ErrSelector("") && !c.expect(']') {
+		return nil
+	}
+	return a
+}
+
+// parseValue parses an attribute value, which is either a quoted string or
+// a name.
+func (c *cssCompiler) parseValue() string {
+	if !c.peek('\'') && !c.peek('"') {
+		return c.parseRequiredName()
+	}
+
+	quote := c.s[c.pos]
+	var b strings.Builder
+	for c.pos++; c.pos < len(c.s); c.pos++ {
+		switch ch := c.s[c.pos]; {
+		case ch == quote:
+			c.pos++
+			return b.String()
+		case ch == '\\' && c.pos+1 < len(c.s):
+			c.pos++
+			b.WriteByte(c.s[c.pos])
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	c.err = ErrSelector("selector has mismatched quotes.")
+	return ""
+}
+
+// parsePseudo parses a pseudo-class selector.
+func (c *cssCompiler) parsePseudo() cssCond {
+	c.pos++
+	name := c.parseRequiredName()
+	if c.err != ErrSelector("") {
+		return nil
+	}
+
+	switch name {
+	case "root":
+		return new(cssRoot)
+	case "empty":
+		return new(cssEmpty)
+	case "first-child":
+		return &cssNth{0, 1, false}
+	case "last-child":
+		return &cssNth{0, 1, true}
+	case "only-child":
+		return new(cssOnlyChild)
+	case "nth-child", "nth-last-child":
+		if !c.expect('(') {
+			return nil
+		}
+		end := strings.IndexByte(c.s[c.pos:], ')')
+		if end < 0 {
+			c.err = ErrSelector("selector ends unexpectedly.")
+			return nil
+		}
+		a, b, ok := parseNth(c.s[c.pos : c.pos+end])
+		if !ok {
+			c.err = ErrSelector("selector has invalid argument for :" + name)
+			return nil
+		}
+		c.pos += end + 1
+		return &cssNth{a, b, name == "nth-last-child"}
+	case "not":
+		if !c.expect('(') {
+			return nil
+		}
+		list := c.parseList()
+		if c.err != ErrSelector("") || !c.expect(')') {
+			return nil
+		}
+		return &cssNot{list}
+	default:
+		c.err = ErrSelector("selector has unknown pseudo-class :" + name)
+		return nil
+	}
+}
+
+// parseNth parses the an+b argument of an :nth-child pseudo-class.
+func parseNth(s string) (a, b int, ok bool) {
+	s = strings.ToLower(strings.Join(strings.Fields(s), ""))
+	switch s {
+	case "odd":
+		return 2, 1, true
+	case "even":
+		return 2, 0, true
+	}
+
+	n := strings.IndexByte(s, 'n')
+	if n < 0 {
+		b, err := strconv.Atoi(s)
+		return 0, b, err == nil
+	}
+
+	switch coef := s[:n]; coef {
+	case "", "+":
+		a = 1
+	case "-":
+		a = -1
+	default:
+		var err error
+		if a, err = strconv.Atoi(coef); err != nil {
+			return 0, 0, false
+		}
+	}
+	if rest := s[n+1:]; rest != "" {
+		if rest[0] != '+' && rest[0] != '-' {
+			return 0, 0, false
+		}
+		var err error
+		if b, err = strconv.Atoi(rest); err != nil {
+			return 0, 0, false
+		}
+	}
+	return a, b, true
+}
+
+// parseRequiredName parses a name, recording an error if there is none.
+func (c *cssCompiler) parseRequiredName() string {
+	if !c.peekName() {
+		c.unexpected()
+		return ""
+	}
+	return c.parseName()
+}
+
+// parseName parses a name, in which any character may be escaped with a
+// backslash.
+func (c *cssCompiler) parseName() string {
+	var b strings.Builder
+	for c.pos < len(c.s) {
+		ch := c.s[c.pos]
+		switch {
+		case ch == '\\' && c.pos+1 < len(c.s):
+			b.WriteByte(c.s[c.pos+1])
+			c.pos += 2
+		case isNameStart(ch) || isDigit(ch) || ch == '-':
+			b.WriteByte(ch)
+			c.pos++
+		default:
+			return b.String()
+		}
+	}
+	return b.String()
+}
+
+// peekName returns true if a name begins at the current position.
+func (c *cssCompiler) peekName() bool {
+	if c.pos >= len(c.s) {
+		return false
+	}
+	ch := c.s[c.pos]
+	return isNameStart(ch) || isDigit(ch) || ch == '-' || (ch == '\\' && c.pos+1 < len(c.s))
+}
+
+// peek returns true if the character at the current position is 'ch'.
+func (c *cssCompiler) peek(ch byte) bool {
+	return c.pos < len(c.s) && c.s[c.pos] == ch
+}
+
+// expect consumes the character 'ch' if it is at the current position.
+// Otherwise, it records an error and returns false.
+func (c *cssCompiler) expect(ch byte) bool {
+	if !c.peek(ch) {
+		c.unexpected()
+		return false
+	}
+	c.pos++
+	return true
+}
+
+// skipSpace skips whitespace and returns the number of bytes skipped.
+func (c *cssCompiler) skipSpace() int {
+	start := c.pos
+	for c.pos < len(c.s) && isWhitespace(c.s[c.pos:c.pos+1]) {
+		c.pos++
+	}
+	return c.pos - start
+}
+
+// unexpected records an error describing the character at the current
+// position.
+func (c *cssCompiler) unexpected() {
+	if c.pos >= len(c.s) {
+		c.err = ErrSelector("selector ends unexpectedly.")
+		return
+	}
+	r, _ := utf8.DecodeRuneInString(c.s[c.pos:])
+	c.err = ErrSelector("selector has unexpected '" + string(r) + "'.")
+}
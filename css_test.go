@@ -0,0 +1,123 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package etree
+
+import "testing"
+
+var cssXML = `<?xml version="1.0"?>
+<library xmlns:p="urn:prices">
+	<shelf id="s1" class="fiction  new">
+		<book lang="en-US"><title class="main">Dune</title><author>Herbert</author></book>
+		<book lang="fr"><title class="main alt">Candide</title><p:price>9</p:price></book>
+		<note/>
+	</shelf>
+	<shelf id="s2" class="reference">
+		<book lang="en"><title>Atlas</title><subtitle>World</subtitle></book>
+		<book lang="de" data-tags="old rare"><title>Faust</title></book>
+		<book><title/></book>
+	</shelf>
+</library>`
+
+func TestQuerySelector(t *testing.T) {
+	doc := NewDocument()
+	err := doc.ReadFromString(cssXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		selector string
+		result   []string
+	}{
+		{"title", []string{"Dune", "Candide", "Atlas", "Faust", ""}},
+		{"book > title.main", []string{"Dune", "Candide"}},
+		{"title.main.alt", []string{"Candide"}},
+		{".alt, subtitle", []string{"Candide", "World"}},
+		{"#s2 title", []string{"Atlas", "Faust", ""}},
+		{"shelf.new book title", []string{"Dune", "Candide"}},
+		{"shelf.fiction > title", nil},
+		{"book[lang] > title", []string{"Dune", "Candide", "Atlas", "Faust"}},
+		{"book[lang=fr] title", []string{"Candide"}},
+		{`book[lang="de"] title`, []string{"Faust"}},
+		{"book[lang^=en] title", []string{"Dune", "Atlas"}},
+		{"book[lang|=en] title", []string{"Dune", "Atlas"}},
+		{"book[lang$='US'] title", []string{"Dune"}},
+		{"book[lang*=r] title", []string{"Candide"}},
+		{"book[data-tags~=rare] title", []string{"Faust"}},
+		{"book[ data-tags ~= 'old' ] title", []string{"Faust"}},
+		{"title + author", []string{"Herbert"}},
+		{"title ~ *", []string{"Herbert", "9", "World"}},
+		{"book:first-child title", []string{"Dune", "Atlas"}},
+		{"book:last-child title", []string{""}},
+		{"shelf > :last-child", []string{"", ""}},
+		{"book > :only-child", []string{"Faust", ""}},
+		{"book:nth-child(2) title", []string{"Candide", "Faust"}},
+		{"book:nth-child(odd) title", []string{"Dune", "Atlas", ""}},
+		{"book:nth-child(2n+1) title", []string{"Dune", "Atlas", ""}},
+		{"book:nth-child(-n+2) title", []string{"Dune", "Candide", "Atlas", "Faust"}},
+		{"book:nth-last-child(1) title", []string{""}},
+		{"book:not([lang]) title, book:not(:first-child):not([lang=fr]) title", []string{"Faust", ""}},
+		{"title:not(.main, :empty)", []string{"Atlas", "Faust"}},
+		{"title:empty", []string{""}},
+		{`p\:price`, []string{"9"}},
+		{"price", []string{"9"}},
+		{":root > shelf#s1 > note", []string{""}},
+	}
+
+	for _, c := range cases {
+		elements := doc.QuerySelectorAll(c.selector)
+		if len(elements) != len(c.result) {
+			t.Errorf("etree: selector '%s' selected %d elements, expected %d", c.selector, len(elements), len(c.result))
+			continue
+		}
+		for i, e := range elements {
+			checkStrEq(t, e.Text(), c.result[i])
+		}
+
+		first := doc.QuerySelector(c.selector)
+		switch {
+		case len(c.result) == 0 && first != nil:
+			t.Errorf("etree: selector '%s' should select no element", c.selector)
+		case len(c.result) > 0 && first != elements[0]:
+			t.Errorf("etree: selector '%s' selected the wrong first element", c.selector)
+		}
+	}
+
+	// Queries select only descendants of the starting element, but may use
+	// its ancestors to satisfy combinators.
+	shelf := doc.QuerySelector("#s2")
+	checkIntEq(t, len(shelf.QuerySelectorAll("library title")), 3)
+	checkIntEq(t, len(shelf.QuerySelectorAll("shelf")), 0)
+
+	checkBoolEq(t, MustCompileSelector("shelf > book").Matches(shelf.ChildElements()[0]), true)
+	checkBoolEq(t, MustCompileSelector("shelf > title").Matches(shelf.ChildElements()[0]), false)
+}
+
+func TestSelectorErrors(t *testing.T) {
+	cases := []struct {
+		selector, err string
+	}{
+		{"", "etree: selector ends unexpectedly."},
+		{"book >", "etree: selector ends unexpectedly."},
+		{"book,", "etree: selector ends unexpectedly."},
+		{"book[lang", "etree: selector ends unexpectedly."},
+		{"book[lang='en]", "etree: selector has mismatched quotes."},
+		{"book[lang=]", "etree: selector has unexpected ']'."},
+		{"book:bogus", "etree: selector has unknown pseudo-class :bogus"},
+		{"book:nth-child(x)", "etree: selector has invalid argument for :nth-child"},
+		{"book:not(title", "etree: selector ends unexpectedly."},
+		{"book > > title", "etree: selector has unexpected '>'."},
+		{"book)", "etree: selector has unexpected ')'."},
+		{"p:price", "etree: selector has unknown pseudo-class :price"},
+	}
+	for _, c := range cases {
+		_, err := CompileSelector(c.selector)
+		if err == nil {
+			t.Errorf("etree: expected error for selector '%s'", c.selector)
+			continue
+		}
+		checkStrEq(t, err.Error(), c.err)
+	}
+}
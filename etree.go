@@ -11,10 +11,12 @@ import (
 	"bytes"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"slices"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
@@ -26,6 +28,28 @@ const (
 // ErrXML is returned when XML parsing fails due to incorrect formatting.
 var ErrXML = errors.New("etree: invalid XML format")
 
+// A ParseError is returned when XML parsing fails because the input's
+// elements are improperly nested or terminated. It wraps ErrXML, so
+// errors.Is(err, ErrXML) reports true for a ParseError.
+type ParseError struct {
+	Position          // location of the error within the XML source
+	Msg      string   // description of the error
+	Expected string   // full tag of the expected end tag, or "" if none
+	Found    string   // full tag of the end tag found, or "" at end of input
+	Stack    []string // full tags of the open elements, outermost first
+	Context  string   // the XML source line surrounding the error, if known
+}
+
+// Error returns the string describing a parse error.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %s at line %d, column %d", ErrXML, e.Msg, e.Line, e.Column)
+}
+
+// Unwrap returns ErrXML.
+func (e *ParseError) Unwrap() error {
+	return ErrXML
+}
+
 // cdataPrefix is used to detect CDATA text when ReadSettings.PreserveCData is
 // true.
 var cdataPrefix = []byte("<![CDATA[")
@@ -35,10 +59,11 @@ var cdataPrefix = []byte("<![CDATA[")
 type ReadSettings struct {
 	// CharsetReader, if non-nil, defines a function to generate
 	// charset-conversion readers, converting from the provided non-UTF-8
-	// charset into UTF-8. If nil, the ReadFrom* functions will use a
-	// "pass-through" CharsetReader that performs no conversion on the reader's
-	// data regardless of the value of the "charset" encoding string. Default:
-	// nil.
+	// charset into UTF-8. If nil, the ReadFrom* functions use a
+	// "pass-through" conversion, leaving the reader's data unchanged. Set it
+	// to NewCharsetReader to convert the charsets NewCharsetReader supports.
+	// UTF-16 input is detected and converted before any CharsetReader is
+	// consulted. Default: nil.
 	CharsetReader func(charset string, input io.Reader) (io.Reader, error)
 
 	// Permissive allows input containing common mistakes such as missing tags
@@ -75,6 +100,23 @@ type ReadSettings struct {
 	// whether an end element is present. Commonly set to xml.HTMLAutoClose.
 	// Default: nil.
 	AutoClose []string
+
+	// TrackPositions causes the source location of each token and attribute
+	// to be recorded as it is read. The recorded location may be retrieved
+	// by calling the token's or attribute's Pos function. This entails
+	// additional processing during ReadFrom* operations. Default: false.
+	TrackPositions bool
+
+	// PreserveFormatting causes the original lexical form of each token to
+	// be recorded as it is read, including attribute quoting, whitespace
+	// within tags, character and entity references, empty-element tags and
+	// the XML declaration. When the document is written, tokens that have
+	// not been modified since they were read are reproduced byte-for-byte,
+	// regardless of the WriteSettings. This entails additional processing
+	// and memory usage during ReadFrom* operations. The original form is
+	// unavailable once the input is converted from another charset, such as
+	// UTF-16 or a charset named by the XML declaration. Default: false.
+	PreserveFormatting bool
 }
 
 // defaultCharsetReader is used by the xml decoder when the ReadSettings
@@ -106,6 +148,13 @@ type WriteSettings struct {
 	// elements that have no child elements. Default: false.
 	CanonicalEndTags bool
 
+	// ExplicitEndTag, if non-nil, is called for each element without child
+	// tokens to decide how it is written: with an explicit end tag
+	// (<script></script>) if the function returns true, or as a
+	// self-closing tag (<br/>) otherwise. It overrides CanonicalEndTags.
+	// Default: nil.
+	ExplicitEndTag func(e *Element) bool
+
 	// CanonicalText forces the production of XML character references for
 	// text data characters &, <, and >. If false, XML character references
 	// are also produced for " and '. Default: false.
@@ -128,6 +177,34 @@ type WriteSettings struct {
 	//
 	// Deprecated: UseCRLF is deprecated. Use IndentSettings.UseCRLF instead.
 	UseCRLF bool
+
+	// MaxLineWidth, if positive, is the number of characters beyond which
+	// output lines are wrapped. A start tag that would extend beyond it is
+	// written with its attributes on separate lines, and, if WrapText is
+	// true, long text is wrapped at whitespace. Lines may still exceed the
+	// width when a single attribute or word does not fit. Default: 0.
+	MaxLineWidth int
+
+	// HangingIndent, if non-empty, is the indentation of wrapped attributes
+	// and text relative to the indentation of the line being wrapped. Each
+	// attribute of a wrapped start tag, including the first, is then written
+	// on a line of its own. If empty, wrapped attributes are aligned with
+	// the first attribute and wrapped text with the start of the text.
+	// Default: "".
+	HangingIndent string
+
+	// WrapText causes text to be wrapped when it extends beyond
+	// MaxLineWidth, by replacing the whitespace between words with newlines.
+	// Text within an element whose xml:space attribute, or that of its
+	// nearest ancestor specifying one, is "preserve" is never wrapped.
+	// Default: false.
+	WrapText bool
+
+	// Indent, if non-nil, causes the output to be indented as specified by
+	// the indent settings, as if the Document's or Element's
+	// IndentWithSettings function had been called before writing, but
+	// without modifying the element tree. Default: nil.
+	Indent *IndentSettings
 }
 
 // dup creates a duplicate of the WriteSettings object.
@@ -135,7 +212,17 @@ func (s *WriteSettings) dup() WriteSettings {
 	return *s
 }
 
-// IndentSettings determine the behavior of the Document's Indent* functions.
+// explicitEndTag returns true if the element e, which has no child tokens,
+// is to be written with an explicit end tag.
+func (s *WriteSettings) explicitEndTag(e *Element) bool {
+	if s.ExplicitEndTag != nil {
+		return s.ExplicitEndTag(e)
+	}
+	return s.CanonicalEndTags
+}
+
+// IndentSettings determine the behavior of the Document's Indent* functions
+// and of indentation applied by WriteSettings.Indent.
 type IndentSettings struct {
 	// Spaces indicates the number of spaces to insert for each level of
 	// indentation. Set to etree.NoIndent to remove all indentation. Ignored
@@ -160,6 +247,17 @@ type IndentSettings struct {
 	// whitespace characters (such as newlines) at the end of the indented
 	// document. Default: false.
 	SuppressTrailingWhitespace bool
+
+	// PreserveTags lists the tags of elements, such as "pre" or
+	// "programlisting", whose contents are never re-indented. Tags are
+	// compared with each element's full tag, including any namespace
+	// prefix. Default: nil.
+	PreserveTags []string
+
+	// PreserveMixedContent causes the contents of elements containing both
+	// non-whitespace character data and other tokens to be left unindented.
+	// Default: false.
+	PreserveMixedContent bool
 }
 
 // NewIndentSettings creates a default IndentSettings record.
@@ -170,6 +268,8 @@ func NewIndentSettings() *IndentSettings {
 		UseCRLF:                    false,
 		PreserveLeafWhitespace:     false,
 		SuppressTrailingWhitespace: false,
+		PreserveTags:               nil,
+		PreserveMixedContent:       false,
 	}
 }
 
@@ -207,6 +307,7 @@ type Writer interface {
 type Token interface {
 	Parent() *Element
 	Index() int
+	Pos() Span
 	WriteTo(w Writer, s *WriteSettings)
 	dup(parent *Element) Token
 	setParent(parent *Element)
@@ -229,13 +330,52 @@ type Document struct {
 	WriteSettings WriteSettings
 }
 
+// A Position identifies a location within the XML source from which a
+// document was read.
+type Position struct {
+	Line   int   // line number, starting at 1
+	Column int   // byte offset within the line, starting at 1
+	Offset int64 // byte offset within the source, starting at 0
+}
+
+// IsValid returns true if the position was recorded while reading XML
+// source.
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// advance returns the position reached after reading the bytes 'b',
+// starting from position p.
+func (p Position) advance(b []byte) Position {
+	for _, c := range b {
+		if c == '\n' {
+			p.Line, p.Column = p.Line+1, 1
+		} else {
+			p.Column++
+		}
+	}
+	p.Offset += int64(len(b))
+	return p
+}
+
+// A Span identifies the range of XML source from which a token or attribute
+// was read. Start is the position of its first byte, and End is the position
+// just past its last byte. Spans are recorded only when the
+// ReadSettings.TrackPositions option is used. Tokens and attributes that were
+// not read from XML source have a zero-valued Span.
+type Span struct {
+	Start, End Position
+}
+
 // An Element represents an XML element, its attributes, and its child tokens.
 type Element struct {
-	Space, Tag string   // namespace prefix and tag
-	Attr       []Attr   // key-value attribute pairs
-	Child      []Token  // child tokens (elements, comments, etc.)
-	parent     *Element // parent element
-	index      int      // token index in parent's children
+	Space, Tag string         // namespace prefix and tag
+	Attr       []Attr         // key-value attribute pairs
+	Child      []Token        // child tokens (elements, comments, etc.)
+	parent     *Element       // parent element
+	index      int            // token index in parent's children
+	pos        Span           // source location of the element
+	src        *elementSource // original lexical form of the element
 }
 
 // An Attr represents a key-value attribute within an XML element.
@@ -243,6 +383,7 @@ type Attr struct {
 	Space, Key string   // The attribute's namespace prefix and key
 	Value      string   // The attribute value string
 	element    *Element // element containing the attribute
+	pos        Span     // source location of the attribute
 }
 
 // charDataFlags are used with CharData tokens to store additional settings.
@@ -264,6 +405,8 @@ type CharData struct {
 	parent *Element
 	index  int
 	flags  charDataFlags
+	pos    Span
+	src    *tokenSource
 }
 
 // A Comment represents an XML comment.
@@ -271,6 +414,8 @@ type Comment struct {
 	Data   string // the comment's text
 	parent *Element
 	index  int
+	pos    Span
+	src    *tokenSource
 }
 
 // A Directive represents an XML directive.
@@ -278,6 +423,8 @@ type Directive struct {
 	Data   string // the directive string
 	parent *Element
 	index  int
+	pos    Span
+	src    *tokenSource
 }
 
 // A ProcInst represents an XML processing instruction.
@@ -286,6 +433,41 @@ type ProcInst struct {
 	Inst   string // the processing instruction value
 	parent *Element
 	index  int
+	pos    Span
+	src    *tokenSource
+}
+
+// A tokenSource records the original lexical form of a token read with
+// ReadSettings.PreserveFormatting, along with the token's value at the time
+// it was read. The lexical form is written only while the token's value is
+// unchanged.
+type tokenSource struct {
+	text  string // the token's original lexical form
+	value string // the token's value when read
+}
+
+// unchanged returns true if the source is available and the token's value
+// still matches it.
+func (s *tokenSource) unchanged(value string) bool {
+	return s != nil && s.value == value
+}
+
+// An elementSource records the original lexical form of an element's start
+// and end tags, read with ReadSettings.PreserveFormatting. It is used only
+// while the element's name is unchanged.
+type elementSource struct {
+	space, tag string
+	attrs      []attrSource // original lexical form of each attribute
+	close      string       // text closing the start tag, such as ">" or " />"
+	end        string       // end tag, or "" if the element had none
+}
+
+// An attrSource records the original lexical form of an attribute,
+// including the whitespace preceding it. It is used only while the
+// attribute's name and value are unchanged.
+type attrSource struct {
+	space, key, value string
+	text              string
 }
 
 // NewDocument creates an XML document without a root element.
@@ -404,6 +586,7 @@ func (d *Document) ReadFromString(s string) error {
 // validateXML determines if the data read from the reader 'r' contains
 // well-formed XML according to the rules set by the go xml package.
 func validateXML(r io.Reader, settings ReadSettings) error {
+	r, _ = detectUTF16(r, false)
 	dec := newDecoder(r, settings)
 	err := dec.Decode(new(interface{}))
 	if err != nil {
@@ -423,9 +606,16 @@ func validateXML(r io.Reader, settings ReadSettings) error {
 // the provided read settings.
 func newDecoder(r io.Reader, settings ReadSettings) *xml.Decoder {
 	d := xml.NewDecoder(r)
-	d.CharsetReader = settings.CharsetReader
-	if d.CharsetReader == nil {
-		d.CharsetReader = defaultCharsetReader
+	cr := settings.CharsetReader
+	if cr == nil {
+		cr = defaultCharsetReader
+	}
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		// UTF-16 input has already been converted by detectUTF16.
+		if isUTF16(charset) {
+			return input, nil
+		}
+		return cr(charset, input)
 	}
 	d.Strict = !settings.Permissive
 	d.Entity = settings.Entity
@@ -438,9 +628,13 @@ func newDecoder(r io.Reader, settings ReadSettings) *xml.Decoder {
 func (d *Document) WriteTo(w io.Writer) (n int64, err error) {
 	xw := newXmlWriter(w)
 	b := bufio.NewWriter(xw)
-	for _, c := range d.Child {
-		c.WriteTo(b, &d.WriteSettings)
+
+	var bw Writer = b
+	if d.WriteSettings.MaxLineWidth > 0 || d.WriteSettings.Indent != nil {
+		bw = newLineWriter(bw, &d.WriteSettings, 0)
 	}
+	children, indented := d.Element.children(bw, &d.WriteSettings)
+	d.Element.writeChildren(bw, &d.WriteSettings, children, indented)
 	err, n = b.Flush(), xw.bytes
 	return
 }
@@ -504,7 +698,7 @@ func (d *Document) IndentWithSettings(s *IndentSettings) {
 		s.UseCRLF = true
 	}
 
-	d.Element.indent(0, getIndentFunc(s), s)
+	d.Element.indent(0, getIndentFunc(s), s, false)
 
 	if s.SuppressTrailingWhitespace {
 		d.Element.stripTrailingWhitespace()
@@ -877,7 +1071,9 @@ func (e *Element) RemoveChildAt(index int) Token {
 }
 
 // autoClose analyzes the stack's top element and the current token to decide
-// whether the top element should be closed.
+// whether the top element should be closed. An auto-closed element has no
+// content or end tag, so the span recorded for its start tag remains its
+// span.
 func (e *Element) autoClose(stack *stack[*Element], t xml.Token, tags []string) {
 	if stack.empty() {
 		return
@@ -900,26 +1096,12 @@ func (e *Element) autoClose(stack *stack[*Element], t xml.Token, tags []string)
 // ReadFrom reads XML from the reader 'ri' and stores the result as a new
 // child of this element.
 func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err error) {
-	var r xmlReader
-	var pr *xmlPeekReader
-	if settings.PreserveCData {
-		pr = newXmlPeekReader(ri)
-		r = pr
-	} else {
-		r = newXmlSimpleReader(ri)
-	}
-
-	attrCheck := make(map[xml.Name]int)
-	dec := newDecoder(r, settings)
+	tr := newTreeReader(ri, settings)
 
 	var stack stack[*Element]
 	stack.push(e)
 	for {
-		if pr != nil {
-			pr.PeekPrepare(dec.InputOffset(), len(cdataPrefix))
-		}
-
-		t, err := dec.RawToken()
+		t, err := tr.token()
 
 		if settings.Permissive && settings.AutoClose != nil {
 			e.autoClose(&stack, t, settings.AutoClose)
@@ -928,64 +1110,339 @@ func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err er
 		switch {
 		case err == io.EOF:
 			if len(stack.data) != 1 {
-				return r.Bytes(), ErrXML
+				return tr.bytes(), tr.parseError(&stack, nil)
 			}
-			return r.Bytes(), nil
+			return tr.bytes(), nil
 		case err != nil:
-			return r.Bytes(), err
+			return tr.bytes(), err
 		case stack.empty():
-			return r.Bytes(), ErrXML
+			return tr.bytes(), tr.parseError(&stack, t)
 		}
 
 		top := stack.peek()
 
 		switch t := t.(type) {
 		case xml.StartElement:
-			e := newElement(t.Name.Space, t.Name.Local, top)
-			if settings.PreserveDuplicateAttrs || len(t.Attr) < 2 {
-				for _, a := range t.Attr {
-					e.addAttr(a.Name.Space, a.Name.Local, a.Value)
-				}
-			} else {
-				for _, a := range t.Attr {
-					if i, contains := attrCheck[a.Name]; contains {
-						e.Attr[i].Value = a.Value
-					} else {
-						attrCheck[a.Name] = e.addAttr(a.Name.Space, a.Name.Local, a.Value)
-					}
-				}
-				clear(attrCheck)
-			}
-			stack.push(e)
+			stack.push(tr.newElement(t, top))
 		case xml.EndElement:
 			if top.Tag != t.Name.Local || top.Space != t.Name.Space {
-				return r.Bytes(), ErrXML
+				return tr.bytes(), tr.parseError(&stack, t)
 			}
-			stack.pop()
-		case xml.CharData:
-			data := string(t)
-			var flags charDataFlags
-			if pr != nil {
-				peekBuf := pr.PeekFinalize()
-				if bytes.Equal(peekBuf, cdataPrefix) {
-					flags = cdataFlag
-				} else if isWhitespace(data) {
-					flags = whitespaceFlag
+			top.pos.End = tr.span().End
+			if top.src != nil {
+				if raw := tr.raw(); raw != nil {
+					top.src.end = string(raw)
+				} else {
+					top.src = nil
 				}
+			}
+			stack.pop()
+		default:
+			tr.newToken(t, top)
+		}
+	}
+}
+
+// A treeReader decodes raw XML tokens from an input stream and converts them
+// into etree tokens according to the read settings.
+type treeReader struct {
+	r          xmlReader
+	pr         *xmlPeekReader
+	rr         *xmlRecordReader
+	cr         *xmlContextReader
+	dec        *xml.Decoder
+	settings   ReadSettings
+	attrCheck  map[xml.Name]int
+	start, end Position // source location of the last token read
+}
+
+// newTreeReader creates a tree reader that decodes XML from the reader 'ri'.
+func newTreeReader(ri io.Reader, settings ReadSettings) *treeReader {
+	tr := &treeReader{
+		settings:  settings,
+		attrCheck: make(map[xml.Name]int),
+	}
+
+	// The context reader buffers the input for the decoder, so it sits
+	// above the byte-counting reader unless the record reader, which must
+	// see each byte the decoder consumes, is in use.
+	var r io.Reader
+	switch {
+	case settings.TrackPositions || settings.PreserveFormatting:
+		tr.cr = newXmlContextReader(ri)
+		tr.rr = newXmlRecordReader(tr.cr)
+		tr.r, r = tr.rr, tr.rr
+	case settings.PreserveCData:
+		tr.pr = newXmlPeekReader(ri)
+		tr.cr = newXmlContextReader(tr.pr)
+		tr.r, r = tr.pr, tr.cr
+	default:
+		tr.r = newXmlSimpleReader(ri)
+		tr.cr = newXmlContextReader(tr.r)
+		r = tr.cr
+	}
+	r, converted := detectUTF16(r, false)
+	tr.dec = newDecoder(r, settings)
+
+	// Recorded input is unusable once the input is converted, because
+	// decoder offsets then refer to the converted input.
+	if converted {
+		tr.stopRecording()
+	}
+	cr := tr.dec.CharsetReader
+	tr.dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		r, err := cr(charset, input)
+		if r != input {
+			tr.stopRecording()
+		}
+		return r, err
+	}
+	return tr
+}
+
+// stopRecording stops retaining the input read, once decoder offsets no
+// longer correspond to it.
+func (tr *treeReader) stopRecording() {
+	tr.cr.Stop()
+	if tr.rr != nil {
+		tr.rr.Stop()
+	}
+}
+
+// bytes returns the number of bytes read from the input stream so far.
+func (tr *treeReader) bytes() int64 {
+	return tr.r.Bytes()
+}
+
+// token returns the next raw XML token from the input stream.
+func (tr *treeReader) token() (xml.Token, error) {
+	if tr.pr != nil {
+		tr.pr.PeekPrepare(tr.dec.InputOffset(), len(cdataPrefix))
+	}
+	if tr.rr != nil {
+		tr.rr.Discard(tr.dec.InputOffset())
+	}
+	tr.start = tr.position()
+	t, err := tr.dec.RawToken()
+	tr.end = tr.position()
+	return t, err
+}
+
+// span returns the source location of the last token read, or an empty span
+// if positions are not being tracked.
+func (tr *treeReader) span() Span {
+	if !tr.settings.TrackPositions {
+		return Span{}
+	}
+	return Span{tr.start, tr.end}
+}
+
+// parseError returns a ParseError describing an unexpected end tag 't' or,
+// if 't' is nil, an unexpected end of input. The stack holds the elements
+// open at the time of the error.
+func (tr *treeReader) parseError(stack *stack[*Element], t xml.Token) *ParseError {
+	err := &ParseError{Position: tr.start}
+	for _, e := range stack.data {
+		if e.parent != nil || e.Tag != "" {
+			err.Stack = append(err.Stack, e.FullTag())
+		}
+	}
+	if len(err.Stack) > 0 {
+		err.Expected = err.Stack[len(err.Stack)-1]
+	}
+
+	if end, ok := t.(xml.EndElement); ok {
+		err.Found = end.Name.Local
+		if end.Name.Space != "" {
+			err.Found = end.Name.Space + ":" + end.Name.Local
+		}
+	}
+
+	switch {
+	case err.Found == "":
+		err.Msg = "unexpected end of input, expected </" + err.Expected + ">"
+	case err.Expected == "":
+		err.Msg = "unexpected end tag </" + err.Found + ">"
+		if roots := stack.data[0].ChildElements(); len(roots) > 0 {
+			err.Msg += " after root element <" + roots[len(roots)-1].FullTag() + ">"
+		}
+	default:
+		err.Msg = "mismatched end tag </" + err.Found + ">, expected </" + err.Expected + ">"
+	}
+
+	err.Context = string(tr.cr.Line(err.Offset, 40))
+	return err
+}
+
+// position returns the decoder's current location within the input stream.
+func (tr *treeReader) position() Position {
+	line, col := tr.dec.InputPos()
+	return Position{Line: line, Column: col, Offset: tr.dec.InputOffset()}
+}
+
+// raw returns the raw input bytes of the last token read. It returns nil if
+// the raw input is unavailable.
+func (tr *treeReader) raw() []byte {
+	if tr.rr == nil {
+		return nil
+	}
+	return tr.rr.Slice(tr.start.Offset, tr.end.Offset)
+}
+
+// newElement creates an element from the XML start element 't' and adds it
+// as the last child of element 'parent'.
+func (tr *treeReader) newElement(t xml.StartElement, parent *Element) *Element {
+	e := newElement(t.Name.Space, t.Name.Local, parent)
+	e.pos = tr.span()
+
+	var spans []Span
+	if tr.settings.TrackPositions && len(t.Attr) > 0 {
+		spans = tr.attrSpans(len(t.Attr))
+	}
+	attrSpan := func(i int) Span {
+		if spans == nil {
+			return Span{}
+		}
+		return spans[i]
+	}
+
+	if tr.settings.PreserveDuplicateAttrs || len(t.Attr) < 2 {
+		for i, a := range t.Attr {
+			j := e.addAttr(a.Name.Space, a.Name.Local, a.Value)
+			e.Attr[j].pos = attrSpan(i)
+		}
+	} else {
+		for i, a := range t.Attr {
+			j, contains := tr.attrCheck[a.Name]
+			if contains {
+				e.Attr[j].Value = a.Value
 			} else {
-				if isWhitespace(data) {
-					flags = whitespaceFlag
-				}
+				j = e.addAttr(a.Name.Space, a.Name.Local, a.Value)
+				tr.attrCheck[a.Name] = j
+			}
+			e.Attr[j].pos = attrSpan(i)
+		}
+		clear(tr.attrCheck)
+	}
+
+	if tr.settings.PreserveFormatting {
+		e.src = tr.elementSource(t)
+	}
+	return e
+}
+
+// elementSource returns the original lexical form of the start element
+// just read. It returns nil if the raw input is unavailable.
+func (tr *treeReader) elementSource(t xml.StartElement) *elementSource {
+	raw := tr.raw()
+	if raw == nil {
+		return nil
+	}
+	ranges := scanAttrs(raw)
+	if len(ranges) != len(t.Attr) {
+		return nil
+	}
+
+	src := &elementSource{space: t.Name.Space, tag: t.Name.Local}
+	last := bytes.IndexAny(raw, " \t\r\n/>")
+	if last < 0 {
+		return nil
+	}
+	for i, r := range ranges {
+		a := t.Attr[i]
+		src.attrs = append(src.attrs, attrSource{
+			space: a.Name.Space,
+			key:   a.Name.Local,
+			value: a.Value,
+			text:  string(raw[last:r[1]]),
+		})
+		last = r[1]
+	}
+	src.close = string(raw[last:])
+	return src
+}
+
+// source returns the original lexical form of the token just read, along
+// with its value, if ReadSettings.PreserveFormatting is enabled and the raw
+// input is available.
+func (tr *treeReader) source(value string) *tokenSource {
+	if !tr.settings.PreserveFormatting {
+		return nil
+	}
+	raw := tr.raw()
+	if raw == nil {
+		return nil
+	}
+	return &tokenSource{string(raw), value}
+}
+
+// attrSpans returns the source locations of the attributes in the start
+// element just read. It returns nil if the locations could not be determined.
+func (tr *treeReader) attrSpans(count int) []Span {
+	raw := tr.raw()
+	if raw == nil {
+		return nil
+	}
+	ranges := scanAttrs(raw)
+	if len(ranges) != count {
+		return nil
+	}
+	spans := make([]Span, count)
+	for i, r := range ranges {
+		start := tr.start.advance(raw[:r[0]])
+		spans[i] = Span{start, start.advance(raw[r[0]:r[1]])}
+	}
+	return spans
+}
+
+// newToken creates a character data, comment, directive or processing
+// instruction token from the XML token 't' and adds it as the last child of
+// element 'parent'. It returns nil if 't' is not one of these token types.
+func (tr *treeReader) newToken(t xml.Token, parent *Element) Token {
+	switch t := t.(type) {
+	case xml.CharData:
+		data := string(t)
+		var flags charDataFlags
+		switch {
+		case tr.pr != nil:
+			peekBuf := tr.pr.PeekFinalize()
+			if bytes.Equal(peekBuf, cdataPrefix) {
+				flags = cdataFlag
+			} else if isWhitespace(data) {
+				flags = whitespaceFlag
+			}
+		case tr.rr != nil && tr.settings.PreserveCData:
+			if bytes.HasPrefix(tr.raw(), cdataPrefix) {
+				flags = cdataFlag
+			} else if isWhitespace(data) {
+				flags = whitespaceFlag
+			}
+		default:
+			if isWhitespace(data) {
+				flags = whitespaceFlag
 			}
-			newCharData(data, flags, top)
-		case xml.Comment:
-			newComment(string(t), top)
-		case xml.Directive:
-			newDirective(string(t), top)
-		case xml.ProcInst:
-			newProcInst(t.Target, string(t.Inst), top)
 		}
+		c := newCharData(data, flags, parent)
+		c.pos = tr.span()
+		c.src = tr.source(c.Data)
+		return c
+	case xml.Comment:
+		c := newComment(string(t), parent)
+		c.pos = tr.span()
+		c.src = tr.source(c.Data)
+		return c
+	case xml.Directive:
+		d := newDirective(string(t), parent)
+		d.pos = tr.span()
+		d.src = tr.source(d.Data)
+		return d
+	case xml.ProcInst:
+		p := newProcInst(t.Target, string(t.Inst), parent)
+		p.pos = tr.span()
+		p.src = tr.source(p.Target + " " + p.Inst)
+		return p
 	}
+	return nil
 }
 
 // SelectAttr finds an element attribute matching the requested 'key' and, if
@@ -1061,14 +1518,15 @@ func (e *Element) FindElement(path string) *Element {
 }
 
 // FindElementPath returns the first element matched by the 'path' object. The
-// function returns nil if no element is found using the path.
+// function returns nil if no element is found using the path. The search
+// ends as soon as the first matching element is found.
 func (e *Element) FindElementPath(path Path) *Element {
-	p := newPather()
-	elements := p.traverse(e, path)
-	if len(elements) > 0 {
-		return elements[0]
-	}
-	return nil
+	var found *Element
+	newPather().walk(e, path, func(e *Element) bool {
+		found = e
+		return false
+	})
+	return found
 }
 
 // FindElements returns a slice of elements matched by the XPath-like 'path'
@@ -1084,6 +1542,32 @@ func (e *Element) FindElementsPath(path Path) []*Element {
 	return p.traverse(e, path)
 }
 
+// EnsurePath returns the first element matched by the XPath-like 'path'
+// string. If no element matches, the elements missing along the path are
+// created, along with the attributes, child elements and text implied by
+// filters such as [@name='value'], [tag='text'] and [text()='text'], and
+// the newly created element at the end of the path is returned. For
+// example:
+//
+//	proxy := doc.EnsurePath("settings/network/proxy[@name='main']")
+//
+// The function returns nil and leaves the tree unchanged if the path
+// contains a step that can't be satisfied by creating an element. It panics
+// if an invalid path string is supplied.
+func (e *Element) EnsurePath(path string) *Element {
+	return MustCompilePath(path).ensure(e)
+}
+
+// SetValueAtPath ensures that an element matching the XPath-like 'path'
+// string exists, as described for EnsurePath, and sets its text. If the
+// path ends in an attribute (e.g., "proxy/@port") or a text() node test,
+// the attribute's value or the element's text is set. The function returns
+// the element whose value was set, or nil if the path can't be ensured. It
+// panics if an invalid path string is supplied.
+func (e *Element) SetValueAtPath(path, text string) *Element {
+	return MustCompilePath(path).setValue(e, text)
+}
+
 // NotNil returns the receiver element if it isn't nil; otherwise, it returns
 // an unparented element with an empty string tag. This function simplifies
 // the task of writing code to ignore not-found results from element queries.
@@ -1121,6 +1605,30 @@ func (e *Element) GetPath() string {
 	return "/" + strings.Join(path, "/")
 }
 
+// GetUniquePath returns an absolute path that selects only this element.
+// Unlike GetPath, each segment of the path uses the element's full tag,
+// including its namespace prefix, followed by the element's position among
+// the sibling elements matched by the same tag (e.g., "/a[1]/b[3]/ns:c[2]").
+// Passing the path to FindElement returns this element.
+func (e *Element) GetUniquePath() string {
+	path := []string{}
+	for seg := e; seg.parent != nil; seg = seg.parent {
+		pos := 0
+		for _, c := range seg.parent.Child {
+			if c, ok := c.(*Element); ok && spaceMatch(seg.Space, c.Space) && seg.Tag == c.Tag {
+				pos++
+				if c == seg {
+					break
+				}
+			}
+		}
+		path = append(path, fmt.Sprintf("%s[%d]", seg.FullTag(), pos))
+	}
+
+	slices.Reverse(path)
+	return "/" + strings.Join(path, "/")
+}
+
 // GetRelativePath returns the path of this element relative to the 'source'
 // element. If the two elements are not part of the same element tree, then
 // the function returns the empty string.
@@ -1199,12 +1707,22 @@ func (e *Element) GetRelativePath(source *Element) string {
 // it is most useful when called just before writing the element as an XML
 // fragment using WriteTo.
 func (e *Element) IndentWithSettings(s *IndentSettings) {
-	e.indent(1, getIndentFunc(s), s)
+	e.indent(1, getIndentFunc(s), s, e.parent.preservesIndentOfChildren(s))
 }
 
 // indent recursively inserts proper indentation between an XML element's
-// child tokens.
-func (e *Element) indent(depth int, indent indentFunc, s *IndentSettings) {
+// child tokens. The 'preserve' parameter indicates whether the indentation
+// of the element's parent is preserved.
+func (e *Element) indent(depth int, indent indentFunc, s *IndentSettings, preserve bool) {
+	if e.preservesIndent(preserve, s) {
+		for _, c := range e.Child {
+			if ce, ok := c.(*Element); ok {
+				ce.indent(depth+1, indent, s, true)
+			}
+		}
+		return
+	}
+
 	e.stripIndent(s)
 	n := len(e.Child)
 	if n == 0 {
@@ -1233,7 +1751,7 @@ func (e *Element) indent(depth int, indent indentFunc, s *IndentSettings) {
 
 		// Recursively process child elements.
 		if ce, ok := c.(*Element); ok {
-			ce.indent(depth+1, indent, s)
+			ce.indent(depth+1, indent, s, false)
 		}
 	}
 
@@ -1248,8 +1766,65 @@ func (e *Element) indent(depth int, indent indentFunc, s *IndentSettings) {
 	}
 }
 
+// preservesIndent returns true if the indentation of the element's contents
+// must be left unchanged, given whether that of its parent is preserved.
+// Indentation is preserved within elements whose xml:space attribute, or
+// that of their nearest ancestor having one, is "preserve", as well as
+// within the elements selected by the PreserveTags and PreserveMixedContent
+// settings and their descendants, unless overridden by an xml:space
+// attribute of "default".
+func (e *Element) preservesIndent(parent bool, s *IndentSettings) bool {
+	preserve := parent
+	for _, a := range e.Attr {
+		if a.Space == "xml" && a.Key == "space" {
+			preserve = a.Value == "preserve"
+		}
+	}
+	switch {
+	case preserve:
+		return true
+	case slices.Contains(s.PreserveTags, e.FullTag()):
+		return true
+	case s.PreserveMixedContent:
+		hasText, hasOther := false, false
+		for _, c := range e.Child {
+			if cd, ok := c.(*CharData); ok {
+				hasText = hasText || !cd.IsWhitespace()
+			} else {
+				hasOther = true
+			}
+		}
+		return hasText && hasOther
+	}
+	return false
+}
+
+// preservesIndentOfChildren returns true if the indentation of the children
+// of element e, which may be nil, must be left unchanged because of the
+// element or its ancestors.
+func (e *Element) preservesIndentOfChildren(s *IndentSettings) bool {
+	if e == nil {
+		return false
+	}
+	return e.preservesIndent(e.parent.preservesIndentOfChildren(s), s)
+}
+
 // stripIndent removes any previously inserted indentation.
 func (e *Element) stripIndent(s *IndentSettings) {
+	newChild := e.unindentedChildren(s)
+	if len(newChild) == len(e.Child) {
+		return
+	}
+	for i, c := range newChild {
+		c.setIndex(i)
+	}
+	e.Child = newChild
+}
+
+// unindentedChildren returns the element's child tokens without the
+// indentation removed by stripIndent. If there is no indentation to remove,
+// it returns the element's Child slice.
+func (e *Element) unindentedChildren(s *IndentSettings) []Token {
 	// Count the number of non-indent child tokens
 	n := len(e.Child)
 	for _, c := range e.Child {
@@ -1258,24 +1833,21 @@ func (e *Element) stripIndent(s *IndentSettings) {
 		}
 	}
 	if n == len(e.Child) {
-		return
+		return e.Child
 	}
 	if n == 0 && len(e.Child) == 1 && s.PreserveLeafWhitespace {
-		return
+		return e.Child
 	}
 
 	// Strip out indent CharData
-	newChild := make([]Token, n)
-	j := 0
+	newChild := make([]Token, 0, n)
 	for _, c := range e.Child {
 		if cd, ok := c.(*CharData); ok && cd.IsWhitespace() {
 			continue
 		}
-		newChild[j] = c
-		newChild[j].setIndex(j)
-		j++
+		newChild = append(newChild, c)
 	}
-	e.Child = newChild
+	return newChild
 }
 
 // stripTrailingWhitespace removes any trailing whitespace CharData tokens
@@ -1298,6 +1870,8 @@ func (e *Element) dup(parent *Element) Token {
 		Child:  make([]Token, len(e.Child)),
 		parent: parent,
 		index:  e.index,
+		pos:    e.pos,
+		src:    e.src,
 	}
 	for i, t := range e.Child {
 		ne.Child[i] = t.dup(ne)
@@ -1347,24 +1921,48 @@ func (e *Element) Index() int {
 	return e.index
 }
 
+// Pos returns the location of this element within the XML source from which
+// it was read, spanning from the start of its start tag to the end of its end
+// tag. Locations are recorded only when ReadSettings.TrackPositions is true.
+func (e *Element) Pos() Span {
+	return e.pos
+}
+
 // WriteTo serializes the element to the writer w.
 func (e *Element) WriteTo(w Writer, s *WriteSettings) {
+	if _, ok := w.(*lineWriter); !ok && (s.MaxLineWidth > 0 || s.Indent != nil) {
+		lw := newLineWriter(w, s, 1)
+		if s.Indent != nil {
+			lw.preserve = e.parent.preservesIndentOfChildren(s.Indent)
+		}
+		w = lw
+	}
+
+	if e.src != nil && e.src.space == e.Space && e.src.tag == e.Tag {
+		e.writeSource(w, s)
+		return
+	}
+
+	children, indented := e.children(w, s)
 	w.WriteByte('<')
 	w.WriteString(e.FullTag())
-	for _, a := range e.Attr {
-		w.WriteByte(' ')
+	first, next := e.attrSeparators(w, s, len(children) == 0)
+	for i, a := range e.Attr {
+		if i == 0 {
+			w.WriteString(first)
+		} else {
+			w.WriteString(next)
+		}
 		a.WriteTo(w, s)
 	}
-	if len(e.Child) > 0 {
+	if len(children) > 0 {
 		w.WriteByte('>')
-		for _, c := range e.Child {
-			c.WriteTo(w, s)
-		}
+		e.writeChildren(w, s, children, indented)
 		w.Write([]byte{'<', '/'})
 		w.WriteString(e.FullTag())
 		w.WriteByte('>')
 	} else {
-		if s.CanonicalEndTags {
+		if s.explicitEndTag(e) {
 			w.Write([]byte{'>', '<', '/'})
 			w.WriteString(e.FullTag())
 			w.WriteByte('>')
@@ -1374,6 +1972,160 @@ func (e *Element) WriteTo(w Writer, s *WriteSettings) {
 	}
 }
 
+// children returns the child tokens of the element to be written to w with
+// the settings 's', and whether they are to be indented. When they are, any
+// existing indentation is omitted.
+func (e *Element) children(w Writer, s *WriteSettings) ([]Token, bool) {
+	lw, ok := w.(*lineWriter)
+	if !ok || lw.indent == nil || e.preservesIndent(lw.preserve, s.Indent) {
+		return e.Child, false
+	}
+	return e.unindentedChildren(s.Indent), true
+}
+
+// writeChildren writes the child tokens 'children' of the element. When
+// they are to be indented, newlines and indentation are written between
+// them in the same way Element.indent inserts them into the element tree.
+func (e *Element) writeChildren(w Writer, s *WriteSettings, children []Token, indented bool) {
+	lw, ok := w.(*lineWriter)
+	if !ok || lw.indent == nil {
+		for _, c := range children {
+			c.WriteTo(w, s)
+		}
+		return
+	}
+
+	depth, preserve := lw.depth, lw.preserve
+	defer func() { lw.depth, lw.preserve = depth, preserve }()
+	lw.preserve = !indented
+	if !indented {
+		lw.depth = depth + 1
+		for _, c := range children {
+			c.WriteTo(w, s)
+		}
+		return
+	}
+
+	isCharData, firstNonCharData := false, true
+	for _, c := range children {
+		_, isCharData = c.(*CharData)
+		if !isCharData {
+			if !firstNonCharData || depth > 0 {
+				w.WriteString(lw.indent(depth))
+			}
+			firstNonCharData = false
+		}
+
+		lw.depth = depth + 1
+		c.WriteTo(w, s)
+	}
+	lw.depth = depth
+
+	// Write the indentation preceding the element's end tag or, for a
+	// document, its trailing newline.
+	if !isCharData && len(children) > 0 {
+		if depth > 0 || (!firstNonCharData && !s.Indent.SuppressTrailingWhitespace) {
+			w.WriteString(lw.indent(depth - 1))
+		}
+	}
+}
+
+// attrSeparators returns the strings written before the element's first
+// attribute and before each of its other attributes. They are single
+// spaces, unless the start tag must be wrapped to fit within
+// WriteSettings.MaxLineWidth. The writer w must be positioned just after the
+// element's tag name, and 'empty' indicates whether the element is written
+// without children.
+func (e *Element) attrSeparators(w Writer, s *WriteSettings, empty bool) (first, next string) {
+	lw, ok := w.(*lineWriter)
+	if !ok || len(e.Attr) == 0 {
+		return " ", " "
+	}
+
+	width := lw.col
+	var b strings.Builder
+	for _, a := range e.Attr {
+		b.Reset()
+		a.WriteTo(&b, s)
+		width += 1 + utf8.RuneCountInString(b.String())
+	}
+	if empty && !s.explicitEndTag(e) {
+		width += 2 // "/>"
+	} else {
+		width++ // ">"
+	}
+	if width <= s.MaxLineWidth {
+		return " ", " "
+	}
+
+	if s.HangingIndent != "" {
+		next = lw.newline() + lw.leading() + s.HangingIndent
+		return next, next
+	}
+	return " ", lw.newline() + lw.alignTo(lw.col+1)
+}
+
+// writeSource serializes the element to the writer w, reproducing the
+// original lexical form of its tags and of its unchanged attributes. An
+// empty element read as a self-closing tag is given an end tag if the write
+// settings call for an explicit one.
+func (e *Element) writeSource(w Writer, s *WriteSettings) {
+	w.WriteByte('<')
+	w.WriteString(e.FullTag())
+	for _, a := range e.Attr {
+		if text := e.src.attrText(&a); text != "" {
+			w.WriteString(text)
+		} else {
+			w.WriteByte(' ')
+			a.WriteTo(w, s)
+		}
+	}
+
+	children, indented := e.children(w, s)
+	if len(children) == 0 && e.src.end == "" && !s.explicitEndTag(e) {
+		w.WriteString(e.src.close)
+		return
+	}
+	if close, ok := strings.CutSuffix(e.src.close, "/>"); ok {
+		w.WriteString(close)
+		w.WriteByte('>')
+	} else {
+		w.WriteString(e.src.close)
+	}
+	e.writeChildren(w, s, children, indented)
+	if e.src.end != "" {
+		w.WriteString(e.src.end)
+	} else {
+		w.Write([]byte{'<', '/'})
+		w.WriteString(e.FullTag())
+		w.WriteByte('>')
+	}
+}
+
+// attrText returns the original lexical form of the attribute a, or the
+// empty string if the attribute has changed since it was read.
+func (src *elementSource) attrText(a *Attr) string {
+	for _, sa := range src.attrs {
+		if sa.space == a.Space && sa.key == a.Key && sa.value == a.Value {
+			return sa.text
+		}
+	}
+	return ""
+}
+
+// preservesSpace returns true if the xml:space attribute of the element, or
+// of its nearest ancestor having one, is "preserve".
+func (e *Element) preservesSpace() bool {
+	for ; e != nil; e = e.parent {
+		for _, a := range e.Attr {
+			if a.Space == "xml" && a.Key == "space" {
+				return a.Value == "preserve"
+			}
+		}
+	}
+	return false
+}
+
 // setParent replaces this element token's parent.
 func (e *Element) setParent(parent *Element) {
 	e.parent = parent
@@ -1436,6 +2188,7 @@ func (e *Element) RemoveAttr(key string) *Attr {
 				Key:     a.Key,
 				Value:   a.Value,
 				element: nil,
+				pos:     a.pos,
 			}
 		}
 	}
@@ -1466,6 +2219,13 @@ func (a *Attr) Element() *Element {
 	return a.element
 }
 
+// Pos returns the location of this attribute within the XML source from
+// which it was read, spanning from the start of its key to the end of its
+// value. Locations are recorded only when ReadSettings.TrackPositions is true.
+func (a *Attr) Pos() Span {
+	return a.pos
+}
+
 // NamespaceURI returns the XML namespace URI associated with this attribute.
 // The function returns the empty string if the attribute is unprefixed or
 // if the attribute is part of the XML default namespace.
@@ -1592,8 +2352,20 @@ func (c *CharData) Index() int {
 	return c.index
 }
 
+// Pos returns the location of this CharData token within the XML source from
+// which it was read. Locations are recorded only when
+// ReadSettings.TrackPositions is true.
+func (c *CharData) Pos() Span {
+	return c.pos
+}
+
 // WriteTo serializes character data to the writer.
 func (c *CharData) WriteTo(w Writer, s *WriteSettings) {
+	if c.src.unchanged(c.Data) && strings.HasPrefix(c.src.text, "<![CDATA[") == c.IsCData() {
+		w.WriteString(c.src.text)
+		return
+	}
+
 	if c.IsCData() {
 		w.WriteString(`<![CDATA[`)
 		w.WriteString(c.Data)
@@ -1605,7 +2377,59 @@ func (c *CharData) WriteTo(w Writer, s *WriteSettings) {
 		} else {
 			m = escapeNormal
 		}
+		if lw, ok := w.(*lineWriter); ok && s.WrapText && !c.IsWhitespace() &&
+			(c.parent == nil || !c.parent.preservesSpace()) {
+			c.writeWrapped(lw, s, m)
+		} else {
+			escapeString(w, c.Data, m)
+		}
+	}
+}
+
+// writeWrapped writes the character data's text, replacing the whitespace
+// between words with newlines where needed to keep lines within
+// WriteSettings.MaxLineWidth. Text that already fits is written unchanged.
+func (c *CharData) writeWrapped(w *lineWriter, s *WriteSettings, m escapeMode) {
+	if c.Data == "" {
+		return
+	}
+	var b strings.Builder
+	escaped := func(text string) string {
+		b.Reset()
+		escapeString(&b, text, m)
+		return b.String()
+	}
+	if strings.IndexByte(c.Data, '\n') < 0 &&
+		w.col+utf8.RuneCountInString(escaped(c.Data)) <= s.MaxLineWidth {
 		escapeString(w, c.Data, m)
+		return
+	}
+
+	words := strings.FieldsFunc(c.Data, isXMLSpace)
+	if isXMLSpace(rune(c.Data[0])) {
+		w.WriteByte(' ')
+	}
+	var wrap string
+	if s.HangingIndent != "" {
+		wrap = w.leading() + s.HangingIndent
+	} else {
+		wrap = w.alignTo(w.col)
+	}
+	wrapWidth := utf8.RuneCountInString(wrap)
+	for i, word := range words {
+		width := utf8.RuneCountInString(escaped(word))
+		switch {
+		case i == 0:
+		case w.col+1+width > s.MaxLineWidth && w.col > wrapWidth:
+			w.WriteString(w.newline())
+			w.WriteString(wrap)
+		default:
+			w.WriteByte(' ')
+		}
+		escapeString(w, word, m)
+	}
+	if isXMLSpace(rune(c.Data[len(c.Data)-1])) {
+		w.WriteByte(' ')
 	}
 }
 
@@ -1616,6 +2440,8 @@ func (c *CharData) dup(parent *Element) Token {
 		flags:  c.flags,
 		parent: parent,
 		index:  c.index,
+		pos:    c.pos,
+		src:    c.src,
 	}
 }
 
@@ -1660,6 +2486,8 @@ func (c *Comment) dup(parent *Element) Token {
 		Data:   c.Data,
 		parent: parent,
 		index:  c.index,
+		pos:    c.pos,
+		src:    c.src,
 	}
 }
 
@@ -1675,8 +2503,20 @@ func (c *Comment) Index() int {
 	return c.index
 }
 
+// Pos returns the location of this Comment token within the XML source from
+// which it was read. Locations are recorded only when
+// ReadSettings.TrackPositions is true.
+func (c *Comment) Pos() Span {
+	return c.pos
+}
+
 // WriteTo serialies the comment to the writer.
 func (c *Comment) WriteTo(w Writer, s *WriteSettings) {
+	if c.src.unchanged(c.Data) {
+		w.WriteString(c.src.text)
+		return
+	}
+
 	w.WriteString("<!--")
 	w.WriteString(c.Data)
 	w.WriteString("-->")
@@ -1724,6 +2564,8 @@ func (d *Directive) dup(parent *Element) Token {
 		Data:   d.Data,
 		parent: parent,
 		index:  d.index,
+		pos:    d.pos,
+		src:    d.src,
 	}
 }
 
@@ -1740,8 +2582,20 @@ func (d *Directive) Index() int {
 	return d.index
 }
 
+// Pos returns the location of this Directive token within the XML source from
+// which it was read. Locations are recorded only when
+// ReadSettings.TrackPositions is true.
+func (d *Directive) Pos() Span {
+	return d.pos
+}
+
 // WriteTo serializes the XML directive to the writer.
 func (d *Directive) WriteTo(w Writer, s *WriteSettings) {
+	if d.src.unchanged(d.Data) {
+		w.WriteString(d.src.text)
+		return
+	}
+
 	w.WriteString("<!")
 	w.WriteString(d.Data)
 	w.WriteString(">")
@@ -1792,6 +2646,8 @@ func (p *ProcInst) dup(parent *Element) Token {
 		Inst:   p.Inst,
 		parent: parent,
 		index:  p.index,
+		pos:    p.pos,
+		src:    p.src,
 	}
 }
 
@@ -1808,8 +2664,20 @@ func (p *ProcInst) Index() int {
 	return p.index
 }
 
+// Pos returns the location of this ProcInst token within the XML source from
+// which it was read. Locations are recorded only when
+// ReadSettings.TrackPositions is true.
+func (p *ProcInst) Pos() Span {
+	return p.pos
+}
+
 // WriteTo serializes the processing instruction to the writer.
 func (p *ProcInst) WriteTo(w Writer, s *WriteSettings) {
+	if p.src.unchanged(p.Target + " " + p.Inst) {
+		w.WriteString(p.src.text)
+		return
+	}
+
 	w.WriteString("<?")
 	w.WriteString(p.Target)
 	if p.Inst != "" {
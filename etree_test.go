@@ -248,6 +248,74 @@ func TestImbalancedXML(t *testing.T) {
 	}
 }
 
+func TestParseError(t *testing.T) {
+	cases := []struct {
+		in                string
+		line, col         int
+		expected, found   string
+		stack             []string
+		context, errorStr string
+	}{
+		{"<a>\n  <b></c>\n</a>", 2, 6, "b", "c", []string{"a", "b"}, "  <b></c>",
+			"etree: invalid XML format: mismatched end tag </c>, expected </b> at line 2, column 6"},
+		{"<a><p:b></b></a>", 1, 9, "p:b", "b", []string{"a", "p:b"}, "<a><p:b></b></a>",
+			"etree: invalid XML format: mismatched end tag </b>, expected </p:b> at line 1, column 9"},
+		{"</x>", 1, 1, "", "x", nil, "</x>",
+			"etree: invalid XML format: unexpected end tag </x> at line 1, column 1"},
+		{"<a></a>\n</x>", 2, 1, "", "x", nil, "</x>",
+			"etree: invalid XML format: unexpected end tag </x> after root element <a> at line 2, column 1"},
+		{"<a></a><b/>junk</b>", 1, 16, "", "b", nil, "<a></a><b/>junk</b>",
+			"etree: invalid XML format: unexpected end tag </b> after root element <b> at line 1, column 16"},
+		{"<a>" + strings.Repeat("<b/>\n", 10000) + "<c></a>", 10001, 4, "c", "a", []string{"a", "c"}, "<c></a>",
+			"etree: invalid XML format: mismatched end tag </a>, expected </c> at line 10001, column 4"},
+		{"<a><b>text", 1, 11, "b", "", []string{"a", "b"}, "<a><b>text",
+			"etree: invalid XML format: unexpected end of input, expected </b> at line 1, column 11"},
+	}
+
+	settings := []ReadSettings{{}, {TrackPositions: true}, {PreserveCData: true}}
+	for _, c := range cases {
+		for _, rs := range settings {
+			doc := NewDocument()
+			doc.ReadSettings = rs
+			err := doc.ReadFromString(c.in)
+			if !errors.Is(err, ErrXML) {
+				t.Errorf("etree: expected ErrXML, got %v", err)
+				continue
+			}
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Errorf("etree: expected ParseError, got %T", err)
+				continue
+			}
+			checkIntEq(t, perr.Line, c.line)
+			checkIntEq(t, perr.Column, c.col)
+			checkStrEq(t, perr.Expected, c.expected)
+			checkStrEq(t, perr.Found, c.found)
+			checkStrEq(t, strings.Join(perr.Stack, "/"), strings.Join(c.stack, "/"))
+			checkStrEq(t, perr.Context, c.context)
+			checkStrEq(t, perr.Error(), c.errorStr)
+		}
+	}
+}
+
+func BenchmarkReadFrom(b *testing.B) {
+	s := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<store>
+	<book lang="en">
+		<title>Great Expectations</title>
+		<author>Charles Dickens</author>
+	</book>
+</store>`)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		doc := NewDocument()
+		if _, err := doc.ReadFrom(bytes.NewReader(s)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestDocumentCharsetReader(t *testing.T) {
 	s := `<?xml version="1.0" encoding="lowercase"?>
 <Store>
@@ -479,6 +547,26 @@ func TestCanonical(t *testing.T) {
 	checkStrEq(t, s, expected)
 }
 
+func TestExplicitEndTag(t *testing.T) {
+	doc := newDocumentFromString(t, `<html><head><script src="a.js"/></head><body><br/><p/></body></html>`)
+	doc.WriteSettings.ExplicitEndTag = func(e *Element) bool {
+		return e.Tag != "br"
+	}
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStrEq(t, s, `<html><head><script src="a.js"></script></head><body><br/><p></p></body></html>`)
+
+	// The function overrides CanonicalEndTags.
+	doc.WriteSettings.CanonicalEndTags = true
+	doc.WriteSettings.ExplicitEndTag = func(e *Element) bool {
+		return e.Tag == "script"
+	}
+	s, _ = doc.WriteToString()
+	checkStrEq(t, s, `<html><head><script src="a.js"></script></head><body><br/><p/></body></html>`)
+}
+
 func TestCopy(t *testing.T) {
 	s := `<store>
 	<book lang="en">
@@ -581,6 +669,38 @@ func TestGetPath(t *testing.T) {
 	}
 }
 
+func TestGetUniquePath(t *testing.T) {
+	doc := newDocumentFromString(t, `<a xmlns:ns="urn:ns">`+
+		`<b/><b/><ns:c/><b><c/><ns:c/><x:c/><ns:c/></b>`+
+		`</a>`)
+
+	cases := []struct {
+		from, path string
+	}{
+		{"/", "/"},
+		{"a", "/a[1]"},
+		{"a/b[2]", "/a[1]/b[2]"},
+		{"a/ns:c", "/a[1]/ns:c[1]"},
+		{"a/b[3]", "/a[1]/b[3]"},
+		{"a/b[3]/c[1]", "/a[1]/b[3]/c[1]"},
+		{"a/b[3]/x:c", "/a[1]/b[3]/x:c[1]"},
+		{"a/b[3]/ns:c[2]", "/a[1]/b[3]/ns:c[2]"},
+	}
+	for _, c := range cases {
+		e := doc.FindElement(c.from)
+		checkStrEq(t, e.GetUniquePath(), c.path)
+		checkElementEq(t, doc.FindElement(c.path), e)
+	}
+
+	// The root of a detached element tree is the path's root.
+	b := doc.FindElement("a/b[3]")
+	b.Parent().RemoveChild(b)
+	checkStrEq(t, b.GetUniquePath(), "/")
+	c := b.FindElement("ns:c[2]")
+	checkStrEq(t, c.GetUniquePath(), "/ns:c[2]")
+	checkElementEq(t, c.FindElement(c.GetUniquePath()), c)
+}
+
 func TestInsertChild(t *testing.T) {
 	s := `<book lang="en">
   <t:title>Great Expectations</t:title>
@@ -1034,6 +1154,170 @@ func TestIndentPreserveWhitespace(t *testing.T) {
 	}
 }
 
+func TestWriteSettingsIndent(t *testing.T) {
+	inputs := []string{
+		`<?xml version="1.0"?><!-- c --><root><child1><child2/></child1></root>`,
+		"<root>\n\t<a>  </a>\n\t<b> text <c/> more </b><!-- c -->\n</root>\n",
+		`<test> <![CDATA[ ]]> </test>`,
+		`<outer> <inner> </inner> <e/></outer>`,
+	}
+	settings := []*IndentSettings{
+		NewIndentSettings(),
+		{Spaces: NoIndent},
+		{UseTabs: true, UseCRLF: true},
+		{Spaces: 2, PreserveLeafWhitespace: true, SuppressTrailingWhitespace: true},
+	}
+
+	for _, input := range inputs {
+		for _, s := range settings {
+			doc := newDocumentFromString(t, input)
+			before, _ := doc.WriteToString()
+			doc.WriteSettings.Indent = s
+			got, err := doc.WriteToString()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The tree is left unchanged.
+			doc.WriteSettings.Indent = nil
+			after, _ := doc.WriteToString()
+			checkStrEq(t, after, before)
+
+			doc.IndentWithSettings(s)
+			want, _ := doc.WriteToString()
+			checkStrEq(t, got, want)
+
+			// Elements are indented as by Element.IndentWithSettings.
+			doc = newDocumentFromString(t, input)
+			var b strings.Builder
+			doc.Root().WriteTo(&b, &WriteSettings{Indent: s})
+			doc.Root().IndentWithSettings(s)
+			var want2 strings.Builder
+			doc.Root().WriteTo(&want2, &WriteSettings{})
+			checkStrEq(t, b.String(), want2.String())
+		}
+	}
+}
+
+func TestIndentPreserve(t *testing.T) {
+	input := `<doc><pre xml:space="preserve">  <b>x</b> <i>y</i>  <p xml:space="default"> <q/> </p></pre>` +
+		`<listing>  <line/>  </listing><para>Some <em>mixed</em> text</para><list> <item/> </list></doc>`
+	tests := []struct {
+		settings *IndentSettings
+		expected string
+	}{
+		{&IndentSettings{Spaces: 2}, `<doc>
+  <pre xml:space="preserve">  <b>x</b> <i>y</i>  <p xml:space="default">
+      <q/>
+    </p></pre>
+  <listing>
+    <line/>
+  </listing>
+  <para>Some 
+    <em>mixed</em> text</para>
+  <list>
+    <item/>
+  </list>
+</doc>
+`},
+		{&IndentSettings{Spaces: 2, PreserveTags: []string{"listing"}, PreserveMixedContent: true}, `<doc>
+  <pre xml:space="preserve">  <b>x</b> <i>y</i>  <p xml:space="default">
+      <q/>
+    </p></pre>
+  <listing>  <line/>  </listing>
+  <para>Some <em>mixed</em> text</para>
+  <list>
+    <item/>
+  </list>
+</doc>
+`},
+	}
+
+	for _, test := range tests {
+		// Indenting at write time.
+		doc := newDocumentFromString(t, input)
+		doc.WriteSettings.Indent = test.settings
+		got, _ := doc.WriteToString()
+		checkStrEq(t, got, test.expected)
+
+		// Indenting the tree, repeatedly.
+		doc.WriteSettings.Indent = nil
+		doc.IndentWithSettings(test.settings)
+		doc.IndentWithSettings(test.settings)
+		got, _ = doc.WriteToString()
+		checkStrEq(t, got, test.expected)
+	}
+
+	// Indenting an element within preserved content.
+	doc := newDocumentFromString(t, input)
+	doc.FindElement("//pre/b").IndentWithSettings(NewIndentSettings())
+	doc.FindElement("//pre/p/q").IndentWithSettings(NewIndentSettings())
+	got, _ := doc.WriteToString()
+	checkStrEq(t, got, input)
+}
+
+func TestMaxLineWidth(t *testing.T) {
+	doc := NewDocument()
+	root := doc.CreateElement("root")
+	e := root.CreateElement("element")
+	e.CreateAttr("first", "one")
+	e.CreateAttr("second", "two")
+	e.CreateAttr("third", "three")
+	e.CreateElement("short").CreateAttr("a", "b")
+	text := "The quick brown fox jumps over the lazy dog & runs."
+	root.CreateElement("p").SetText(text)
+	pre := root.CreateElement("pre")
+	pre.CreateAttr("xml:space", "preserve")
+	pre.CreateElement("code").SetText(text)
+	doc.Indent(2)
+
+	doc.WriteSettings.MaxLineWidth = 30
+	doc.WriteSettings.WrapText = true
+	got, _ := doc.WriteToString()
+	checkStrEq(t, got, `<root>
+  <element first="one"
+           second="two"
+           third="three">
+    <short a="b"/>
+  </element>
+  <p>The quick brown fox jumps
+     over the lazy dog &amp;
+     runs.</p>
+  <pre xml:space="preserve"><code>The quick brown fox jumps over the lazy dog &amp; runs.</code></pre>
+</root>
+`)
+
+	doc.WriteSettings.HangingIndent = "    "
+	got, _ = doc.WriteToString()
+	checkStrEq(t, got, `<root>
+  <element
+      first="one"
+      second="two"
+      third="three">
+    <short a="b"/>
+  </element>
+  <p>The quick brown fox jumps
+      over the lazy dog &amp;
+      runs.</p>
+  <pre xml:space="preserve"><code>The quick brown fox jumps over the lazy dog &amp; runs.</code></pre>
+</root>
+`)
+
+	// Text is only wrapped when WrapText is true.
+	doc.WriteSettings.WrapText = false
+	var b strings.Builder
+	doc.FindElement("//p").WriteTo(&b, &doc.WriteSettings)
+	checkStrEq(t, b.String(), "<p>"+strings.ReplaceAll(text, "&", "&amp;")+"</p>")
+
+	// Empty text beyond the line width is written without wrapping.
+	doc = NewDocument()
+	doc.CreateElement("long-root-element").CreateCharData("")
+	doc.WriteSettings.MaxLineWidth = 5
+	doc.WriteSettings.WrapText = true
+	got, _ = doc.WriteToString()
+	checkStrEq(t, got, "<long-root-element></long-root-element>")
+}
+
 func TestPreserveCData(t *testing.T) {
 	tests := []struct {
 		input                   string
@@ -1556,6 +1840,110 @@ func TestNotNil(t *testing.T) {
 	}
 }
 
+func TestEnsurePath(t *testing.T) {
+	doc := newDocumentFromString(t, `<settings><network><proxy name="backup"/></network></settings>`)
+
+	network := doc.FindElement("settings/network")
+	backup := doc.FindElement("//proxy")
+	checkElementEq(t, doc.EnsurePath("settings/network"), network)
+	checkElementEq(t, doc.EnsurePath("settings/network/proxy[@name='backup']"), backup)
+
+	proxy := doc.EnsurePath("settings/network/proxy[@name='main']")
+	checkStrEq(t, proxy.GetPath(), "/settings/network/proxy")
+	checkElementEq(t, doc.EnsurePath("/settings/network/proxy[@name='main']"), proxy)
+	checkElementEq(t, proxy.EnsurePath(".."), network)
+
+	doc.EnsurePath("settings/log[level='debug'][@enabled]")
+	doc.EnsurePath("settings/server[text()='a'][3]")
+	doc.SetValueAtPath("settings/network/proxy[@name='main']/host", "example.com")
+	doc.SetValueAtPath("settings/network/proxy[@name='main']/@port", "8080")
+	doc.SetValueAtPath("settings/server[1]/text()", "b")
+	checkDocEq(t, doc, `<settings>`+
+		`<network><proxy name="backup"/><proxy name="main" port="8080"><host>example.com</host></proxy></network>`+
+		`<log enabled=""><level>debug</level></log>`+
+		`<server>b</server><server>a</server><server>a</server>`+
+		`</settings>`)
+
+	// Paths that can't be satisfied by creating elements leave the
+	// document unchanged.
+	failures := []string{
+		"settings/new/*",
+		"settings/new/missing/../../../..",
+		"settings/new[@a='1'][@a='2']",
+		"settings/new[position() > 1]",
+		"settings/new/ancestor::missing",
+		"settings/log | settings/new",
+	}
+	for _, path := range failures {
+		if e := doc.EnsurePath(path); e != nil {
+			t.Errorf("etree: EnsurePath(%q) should fail, got %s", path, e.GetPath())
+		}
+	}
+	if e := doc.SetValueAtPath("settings/new/@*", "x"); e != nil {
+		t.Error("etree: SetValueAtPath should fail for an attribute wildcard")
+	}
+	checkIntEq(t, len(doc.FindElements("//new")), 0)
+	checkIntEq(t, len(doc.FindElements("//missing")), 0)
+}
+
+func TestPreserveFormatting(t *testing.T) {
+	s := "<?xml version='1.0' encoding=\"UTF-8\" ?>\r\n" +
+		"<!DOCTYPE root>\n" +
+		"<root  a = 'x'\n      b=\"y\" >\n" +
+		"  <empty></empty>\n" +
+		"  <self />\n" +
+		"  <text>&#169; 2024 &amp; &lt;tag&gt; &quot;</text>\n" +
+		"  <cdata><![CDATA[<raw>]]></cdata>\n" +
+		"  <!-- comment -->\n" +
+		"  <?pi   data ?>\n" +
+		"</root   >\n"
+
+	settings := ReadSettings{PreserveFormatting: true, PreserveCData: true}
+	doc := newDocumentFromString2(t, s, settings)
+	checkWrite := func(doc *Document, want string) {
+		t.Helper()
+		got, err := doc.WriteToString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStrBinaryEq(t, got, want)
+	}
+	checkWrite(doc, s)
+	checkWrite(doc.Copy(), s)
+
+	// Only the modified parts of the document are normalized.
+	root := doc.Root()
+	root.CreateAttr("b", "z")
+	root.CreateAttr("c", "w")
+	doc.FindElement("//self").CreateElement("new")
+	doc.FindElement("//text").SetText("© 2024")
+	doc.FindElement("//empty").Tag = "renamed"
+	checkWrite(doc, "<?xml version='1.0' encoding=\"UTF-8\" ?>\r\n"+
+		"<!DOCTYPE root>\n"+
+		"<root  a = 'x' b=\"z\" c=\"w\" >\n"+
+		"  <renamed/>\n"+
+		"  <self ><new/></self>\n"+
+		"  <text>© 2024</text>\n"+
+		"  <cdata><![CDATA[<raw>]]></cdata>\n"+
+		"  <!-- comment -->\n"+
+		"  <?pi   data ?>\n"+
+		"</root   >\n")
+
+	// Preserved self-closing tags honor explicit end tag settings.
+	doc = newDocumentFromString2(t, `<a><x/><y /><z></z></a>`, settings)
+	doc.WriteSettings.CanonicalEndTags = true
+	checkWrite(doc, `<a><x></x><y ></y><z></z></a>`)
+	doc.WriteSettings.ExplicitEndTag = func(e *Element) bool { return e.Tag == "y" }
+	checkWrite(doc, `<a><x/><y ></y><z></z></a>`)
+
+	// Without the setting, the document is normalized.
+	doc = newDocumentFromString(t, s)
+	got, _ := doc.WriteToString()
+	if got == s {
+		t.Error("etree: document should be normalized without PreserveFormatting")
+	}
+}
+
 func TestValidateInput(t *testing.T) {
 	tests := []struct {
 		s   string
@@ -1710,3 +2098,90 @@ func TestContinuations(t *testing.T) {
 
 	checkStrEq(t, s, expected)
 }
+
+func TestTrackPositions(t *testing.T) {
+	s := "<?xml version=\"1.0\"?>\n" +
+		"<root a=\"1\">\n" +
+		"\t<!--c--><child  b = 'x'\n" +
+		"\t\tc=\"y\"/>\n" +
+		"\t<![CDATA[data]]>\n" +
+		"</root>"
+
+	doc := newDocumentFromString2(t, s, ReadSettings{TrackPositions: true, PreserveCData: true})
+
+	checkPos := func(got Position, line, col int, offset int64) {
+		t.Helper()
+		if got.Line != line || got.Column != col || got.Offset != offset {
+			t.Errorf("etree: unexpected position. Got: %d:%d@%d. Wanted: %d:%d@%d.\n",
+				got.Line, got.Column, got.Offset, line, col, offset)
+		}
+	}
+
+	pi := doc.Child[0].(*ProcInst)
+	checkPos(pi.Pos().Start, 1, 1, 0)
+	checkPos(pi.Pos().End, 1, 22, 21)
+
+	root := doc.Root()
+	checkPos(root.Pos().Start, 2, 1, 22)
+	checkPos(root.Pos().End, 6, 8, int64(len(s)))
+	checkPos(root.Attr[0].Pos().Start, 2, 7, 28)
+	checkPos(root.Attr[0].Pos().End, 2, 12, 33)
+
+	comment := root.Child[1].(*Comment)
+	checkPos(comment.Pos().Start, 3, 2, 36)
+	checkPos(comment.Pos().End, 3, 10, 44)
+
+	child := root.SelectElement("child")
+	checkPos(child.Pos().Start, 3, 10, 44)
+	checkPos(child.Pos().End, 4, 10, 69)
+	checkPos(child.Attr[0].Pos().Start, 3, 18, 52)
+	checkPos(child.Attr[0].Pos().End, 3, 25, 59)
+	checkPos(child.Attr[1].Pos().Start, 4, 3, 62)
+	checkPos(child.Attr[1].Pos().End, 4, 8, 67)
+
+	cdata := root.Child[4].(*CharData)
+	checkBoolEq(t, cdata.IsCData(), true)
+	checkPos(cdata.Pos().Start, 5, 2, 71)
+
+	// Positions are carried through copies.
+	c := child.Copy()
+	checkPos(c.Pos().Start, 3, 10, 44)
+	checkPos(c.Attr[1].Pos().Start, 4, 3, 62)
+
+	// Positions are not recorded by default.
+	doc = newDocumentFromString(t, s)
+	if doc.Root().Pos().Start.IsValid() || doc.Root().Attr[0].Pos().Start.IsValid() {
+		t.Errorf("etree: positions should not be recorded by default")
+	}
+}
+
+func TestTrackPositionsAutoClose(t *testing.T) {
+	s := "<p>a<br>b<br></p><br>"
+	settings := ReadSettings{
+		Permissive:     true,
+		AutoClose:      xml.HTMLAutoClose,
+		TrackPositions: true,
+	}
+	check := func(e *Element, start, end int64) {
+		t.Helper()
+		pos := e.Pos()
+		if !pos.Start.IsValid() || !pos.End.IsValid() || pos.Start.Offset != start || pos.End.Offset != end {
+			t.Errorf("etree: unexpected span %+v for <%s>, wanted offsets %d-%d", pos, e.Tag, start, end)
+		}
+	}
+
+	doc := newDocumentFromString2(t, s, settings)
+	check(doc.FindElement("/p/br[1]"), 4, 8)
+	check(doc.FindElement("/p/br[2]"), 9, 13)
+	check(doc.FindElement("/br"), 17, 21)
+	check(doc.Root(), 0, 17)
+
+	// Auto-closed elements returned by a stream reader.
+	elements, err := readStream(t, s, "//br", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIntEq(t, len(elements), 3)
+	check(elements[0], 4, 8)
+	check(elements[2], 17, 21)
+}
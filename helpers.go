@@ -5,6 +5,7 @@
 package etree
 
 import (
+	"bytes"
 	"io"
 	"strings"
 	"unicode/utf8"
@@ -59,6 +60,10 @@ func (f *queue[E]) remove() E {
 	return value
 }
 
+func (f *queue[E]) peek() E {
+	return f.data[f.head]
+}
+
 func (f *queue[E]) len() int {
 	if f.tail >= f.head {
 		return f.tail - f.head
@@ -218,6 +223,172 @@ func (xr *xmlPeekReader) updatePeekBuf() {
 	}
 }
 
+// xmlRecordReader implements a proxy byte reader that counts the number of
+// bytes read from its encapsulated reader. It also records the bytes it
+// reads, so that the raw input at a range of offsets may be retrieved after
+// it has been parsed. Because it implements io.ByteReader, the xml decoder
+// reads from it directly without any additional buffering.
+type xmlRecordReader struct {
+	r         byteReader
+	bytes     int64  // total bytes read
+	buf       []byte // recorded bytes
+	bufOffset int64  // total read offset of the start of buf
+	recording bool   // false if recording has been stopped
+}
+
+func newXmlRecordReader(r byteReader) *xmlRecordReader {
+	return &xmlRecordReader{
+		r:         r,
+		buf:       make([]byte, 0, 256),
+		recording: true,
+	}
+}
+
+func (xr *xmlRecordReader) Bytes() int64 {
+	return xr.bytes
+}
+
+func (xr *xmlRecordReader) Read(p []byte) (n int, err error) {
+	n, err = xr.r.Read(p)
+	if xr.recording {
+		xr.buf = append(xr.buf, p[:n]...)
+	}
+	xr.bytes += int64(n)
+	return n, err
+}
+
+func (xr *xmlRecordReader) ReadByte() (byte, error) {
+	b, err := xr.r.ReadByte()
+	if err != nil {
+		return b, err
+	}
+	if xr.recording {
+		xr.buf = append(xr.buf, b)
+	}
+	xr.bytes++
+	return b, nil
+}
+
+// Slice returns the recorded bytes in the offset range [start, end). It
+// returns nil if the range is no longer (or was never) recorded.
+func (xr *xmlRecordReader) Slice(start, end int64) []byte {
+	if !xr.recording || start < xr.bufOffset || end > xr.bufOffset+int64(len(xr.buf)) || start > end {
+		return nil
+	}
+	return xr.buf[start-xr.bufOffset : end-xr.bufOffset]
+}
+
+// Discard drops all recorded bytes preceding the offset.
+func (xr *xmlRecordReader) Discard(offset int64) {
+	n := offset - xr.bufOffset
+	if n <= 0 {
+		return
+	}
+	if n > int64(len(xr.buf)) {
+		n = int64(len(xr.buf))
+	}
+	xr.buf = xr.buf[:copy(xr.buf, xr.buf[n:])]
+	xr.bufOffset += n
+}
+
+// Stop stops recording. It is called when the input offsets reported by
+// the xml decoder no longer correspond to the offsets of the bytes read,
+// as happens when the input is converted by a CharsetReader.
+func (xr *xmlRecordReader) Stop() {
+	xr.recording, xr.buf = false, nil
+}
+
+// contextKeep is the number of previously consumed bytes an
+// xmlContextReader retains when it refills its buffer.
+const contextKeep = 128
+
+// xmlContextReader implements a buffered proxy byte reader that takes the
+// place of the xml decoder's own read buffer. When it refills the buffer it
+// retains the last few bytes already consumed, so that the input
+// surrounding a parse error can be reported without copying the input
+// anywhere else.
+type xmlContextReader struct {
+	r        io.Reader
+	buf      []byte
+	pos, end int   // unread bytes are buf[pos:end]
+	offset   int64 // total read offset of buf[0]
+	err      error
+	stopped  bool // true if offsets no longer correspond to the input
+}
+
+func newXmlContextReader(r io.Reader) *xmlContextReader {
+	return &xmlContextReader{r: r, buf: make([]byte, 4096)}
+}
+
+func (xr *xmlContextReader) fill() error {
+	if xr.err != nil {
+		return xr.err
+	}
+	keep := min(xr.pos, contextKeep)
+	copy(xr.buf, xr.buf[xr.pos-keep:xr.pos])
+	xr.offset += int64(xr.pos - keep)
+	xr.pos, xr.end = keep, keep
+	for i := 0; i < 100; i++ {
+		n, err := xr.r.Read(xr.buf[xr.end:])
+		xr.end += n
+		xr.err = err
+		if n > 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return io.ErrNoProgress
+}
+
+func (xr *xmlContextReader) Read(p []byte) (n int, err error) {
+	if xr.pos == xr.end {
+		if err = xr.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, xr.buf[xr.pos:xr.end])
+	xr.pos += n
+	return n, nil
+}
+
+func (xr *xmlContextReader) ReadByte() (byte, error) {
+	for xr.pos == xr.end {
+		if err := xr.fill(); err != nil {
+			return 0, err
+		}
+	}
+	b := xr.buf[xr.pos]
+	xr.pos++
+	return b, nil
+}
+
+// Stop stops reporting the data read from the encapsulated reader.
+func (xr *xmlContextReader) Stop() {
+	xr.stopped = true
+}
+
+// Line returns the buffered data on the same line as the input offset,
+// including at most maxLen bytes on either side of the offset. It returns
+// nil if the data at the offset is no longer buffered.
+func (xr *xmlContextReader) Line(offset int64, maxLen int) []byte {
+	i := offset - xr.offset
+	if xr.stopped || i < 0 || i > int64(xr.end) {
+		return nil
+	}
+
+	data := xr.buf[max(int(i)-maxLen, 0):min(int(i)+maxLen, xr.end)]
+	n := min(int(i), maxLen)
+	if nl := bytes.LastIndexByte(data[:n], '\n'); nl >= 0 {
+		data, n = data[nl+1:], n-nl-1
+	}
+	if nl := bytes.IndexAny(data[n:], "\r\n"); nl >= 0 {
+		data = data[:n+nl]
+	}
+	return data
+}
+
 // xmlWriter implements a proxy writer that counts the number of
 // bytes written by its encapsulated writer.
 type xmlWriter struct {
@@ -235,6 +406,99 @@ func (xw *xmlWriter) Write(p []byte) (n int, err error) {
 	return n, err
 }
 
+// lineWriter implements a proxy writer that tracks the column at which the
+// next character will be written and the indentation of the current line,
+// so that long lines can be wrapped. It also tracks the depth of the
+// elements being written, so that they can be indented.
+type lineWriter struct {
+	w        Writer
+	col      int    // number of characters written on the current line
+	lead     []byte // leading whitespace of the current line
+	inLead   bool   // true while only whitespace is on the current line
+	crlf     bool   // true if the last newline written was "\r\n"
+	lastByte byte
+	depth    int        // indentation depth of the children being written
+	preserve bool       // true if their indentation is preserved
+	indent   indentFunc // nil unless WriteSettings.Indent is set
+}
+
+// newLineWriter creates a line writer for output written with the settings
+// 's', starting at the indentation depth 'depth'.
+func newLineWriter(w Writer, s *WriteSettings, depth int) *lineWriter {
+	lw := &lineWriter{w: w, inLead: true, depth: depth}
+	if s.Indent != nil {
+		// WriteSettings.UseCRLF is deprecated. Until removed from the
+		// package, it overrides IndentSettings.UseCRLF when true.
+		is := *s.Indent
+		is.UseCRLF = is.UseCRLF || s.UseCRLF
+		lw.indent = getIndentFunc(&is)
+	}
+	return lw
+}
+
+func (lw *lineWriter) WriteString(s string) (n int, err error) {
+	for i := 0; i < len(s); i++ {
+		lw.track(s[i])
+	}
+	return lw.w.WriteString(s)
+}
+
+func (lw *lineWriter) Write(p []byte) (n int, err error) {
+	for _, c := range p {
+		lw.track(c)
+	}
+	return lw.w.Write(p)
+}
+
+func (lw *lineWriter) WriteByte(c byte) error {
+	lw.track(c)
+	return lw.w.WriteByte(c)
+}
+
+func (lw *lineWriter) track(c byte) {
+	switch {
+	case c == '\n':
+		lw.col, lw.lead, lw.inLead = 0, lw.lead[:0], true
+		lw.crlf = lw.lastByte == '\r'
+	case utf8.RuneStart(c):
+		lw.col++
+		if lw.inLead {
+			if c == ' ' || c == '\t' {
+				lw.lead = append(lw.lead, c)
+			} else {
+				lw.inLead = false
+			}
+		}
+	}
+	lw.lastByte = c
+}
+
+// newline returns the newline sequence last written, or a linefeed if none
+// has been written.
+func (lw *lineWriter) newline() string {
+	if lw.crlf {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// leading returns the leading whitespace of the current line.
+func (lw *lineWriter) leading() string {
+	return string(lw.lead)
+}
+
+// alignTo returns the indentation of a line whose text starts at column
+// 'col' of the current line: the current line's leading whitespace
+// followed by spaces.
+func (lw *lineWriter) alignTo(col int) string {
+	return lw.leading() + strings.Repeat(" ", max(col-len(lw.lead), 0))
+}
+
+// isXMLSpace returns true if the rune is an XML whitespace character.
+func isXMLSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
 // isWhitespace returns true if the byte slice contains only
 // whitespace characters.
 func isWhitespace(s string) bool {
@@ -267,6 +531,15 @@ func spaceDecompose(str string) (space, key string) {
 	return str[:colon], str[colon+1:]
 }
 
+// spaceCompose joins a namespace prefix and a tag or key into a
+// namespace:tag identifier. It is the inverse of spaceDecompose.
+func spaceCompose(space, key string) string {
+	if space == "" {
+		return key
+	}
+	return space + ":" + key
+}
+
 // Strings used by indentCRLF and indentLF
 const (
 	indentSpaces = "\r\n                                                                "
@@ -310,14 +583,64 @@ func nextIndex(s string, ch byte, offset int) int {
 	}
 }
 
-// isInteger returns true if the string s contains an integer.
-func isInteger(s string) bool {
-	for i := 0; i < len(s); i++ {
-		if (s[i] < '0' || s[i] > '9') && !(i == 0 && s[i] == '-') {
-			return false
+// scanAttrs scans the raw bytes of an XML start tag and returns the start
+// and end offsets of each attribute it contains, in the order they appear.
+// Each range begins with the attribute's name and ends just past its value.
+func scanAttrs(raw []byte) [][2]int {
+	isSpace := func(c byte) bool {
+		return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+	}
+	isNameEnd := func(c byte) bool {
+		return isSpace(c) || c == '=' || c == '/' || c == '>'
+	}
+
+	var attrs [][2]int
+	i := 1
+	for i < len(raw) && !isNameEnd(raw[i]) {
+		i++
+	}
+	for {
+		for i < len(raw) && isSpace(raw[i]) {
+			i++
+		}
+		if i >= len(raw) || raw[i] == '/' || raw[i] == '>' {
+			return attrs
+		}
+		start := i
+		for i < len(raw) && !isNameEnd(raw[i]) {
+			i++
+		}
+		end := i
+		for i < len(raw) && isSpace(raw[i]) {
+			i++
+		}
+		if i < len(raw) && raw[i] == '=' {
+			i++
+			for i < len(raw) && isSpace(raw[i]) {
+				i++
+			}
+			if i < len(raw) && (raw[i] == '\'' || raw[i] == '"') {
+				q := raw[i]
+				for i++; i < len(raw) && raw[i] != q; i++ {
+				}
+				i++
+			} else {
+				for i < len(raw) && !isSpace(raw[i]) && raw[i] != '>' {
+					i++
+				}
+			}
+			end = i
+		} else {
+			i = end
+		}
+		if end > len(raw) {
+			end = len(raw)
+		}
+		attrs = append(attrs, [2]int{start, end})
+		if i == start {
+			i++
 		}
 	}
-	return true
 }
 
 type escapeMode byte
@@ -5,8 +5,10 @@
 package etree
 
 import (
+	"slices"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 /*
@@ -32,6 +34,55 @@ The following selectors are supported by etree paths:
 	//              Select all descendants of the current element.
 	tag             Select all child elements with a name matching the tag.
 
+Selectors may also take the form 'axis::tag' or 'axis::*', which selects all
+elements along the named axis having a matching name (or any name). The
+following axes are supported:
+
+	self                        The current element.
+	child                       Child elements of the current element.
+	parent                      The parent of the current element.
+	descendant                  All descendants of the current element.
+	descendant-or-self          The current element and all its descendants.
+	ancestor                    All ancestors of the current element.
+	ancestor-or-self            The current element and all its ancestors.
+	following-sibling           All siblings following the current element.
+	preceding-sibling           All siblings preceding the current element.
+	following                   All elements following the current element's
+	                            end tag in document order.
+	preceding                   All elements preceding the current element's
+	                            start tag in document order, except ancestors.
+
+Two or more paths may be combined with the union operator '|'. The combined
+path selects all elements selected by any of the paths, without duplicates
+and in document order. The union operator may also be used to combine paths
+within filter expressions.
+
+A path ending in '/@attrib', '/text()' or '/comment()' selects attributes,
+text nodes or comments instead of elements, and a path may also consist of a
+filter expression such as 'count(//book)' producing a string, number or
+boolean value. These paths may be evaluated using the Path's Evaluate method.
+The Find* methods return only the elements such paths select.
+
+Paths compiled with CompilePathNS resolve the namespace prefixes of element
+and attribute names using a map of prefixes to namespace URIs. Elements and
+attributes are then matched by namespace URI and local name, regardless of
+the prefixes used within the document. For example, when compiled with a map
+binding the prefix 'soap' to 'http://schemas.xmlsoap.org/soap/envelope/',
+the path '//soap:Body' selects Body elements in that namespace whether the
+document names them 'soap:Body', 's:Body' or simply 'Body' within the scope
+of a default namespace declaration.
+
+Filter expressions may refer to variables of the form '$name', whose values
+are bound by calling the compiled Path's WithVariables method. Binding values
+this way allows a single compiled path to be reused with different values,
+and avoids the need to quote and escape values within path strings. Paths
+compiled with CompilePathWithOptions may also call custom functions.
+
+Elements along the ancestor, ancestor-or-self, preceding-sibling and preceding
+axes are considered in reverse document order, so that positional filters
+count outward from the current element. For example, the path
+'preceding-sibling::label[1]' selects the nearest preceding label sibling.
+
 The following basic filters are supported:
 
 	[@attrib]       Keep elements with an attribute named attrib.
@@ -51,6 +102,47 @@ The following function-based filters are supported:
 	[namespace-uri()]           Keep elements with non-empty namespace URIs.
 	[namespace-uri()='val']     Keep elements whose namespace URI matches val.
 
+Filters may also contain expressions built from the basic and function-based
+filters above, string and number literals, relative paths such as
+'author/@id', and the following operators and functions:
+
+	=  !=                       Equality and inequality.
+	<  <=  >  >=                Numeric comparison.
+	+  -  *  div  mod           Arithmetic.
+	and  or                     Boolean conjunction and disjunction.
+	( )                         Grouping of sub-expressions.
+	position()                  Position of the element among the candidates.
+	last()                      Number of candidates (i.e., the last position).
+	count(path)                 Number of elements or attributes selected.
+	not(x)                      Boolean negation.
+	true()  false()             Boolean constants.
+	boolean(x)                  Conversion to a boolean.
+	number(x)                   Conversion to a number.
+	string(x)                   Conversion to a string.
+
+The following string functions may be used within filter expressions. When
+called without the optional argument 's', they operate on the text of the
+element being filtered.
+
+	concat(a, b, ...)           Concatenation of two or more strings.
+	contains(s, t)              True if string s contains t.
+	starts-with(s, t)           True if string s starts with t.
+	ends-with(s, t)             True if string s ends with t.
+	normalize-space(s)          String s with whitespace trimmed and collapsed.
+	string-length(s)            Number of characters in string s.
+	substring(s, i, n)          Up to n characters of string s starting at i.
+	substring-before(s, t)      Part of string s preceding the first t.
+	substring-after(s, t)       Part of string s following the first t.
+	translate(s, from, to)      String s with characters in from mapped to to.
+	lower-case(s)               String s converted to lower case.
+	upper-case(s)               String s converted to upper case.
+
+As in XPath, a comparison against a path succeeds if it succeeds for any of
+the elements or attributes the path selects. The value of an element is its
+text, and the value of an attribute is its value string. Filter expressions
+producing a number keep only the element at that position, so that [last()]
+keeps the last element and [last()-1] keeps the next-to-last element.
+
 Below are some examples of etree path strings.
 
 Select the bookstore child element of the root element:
@@ -86,9 +178,83 @@ Beginning from the current element, select all descendant book elements
 belonging to the http://www.w3.org/TR/html4/ namespace:
 
 	.//book[namespace-uri()='http://www.w3.org/TR/html4/']
+
+Beginning from the root element, select all descendant book elements priced
+above 30 that don't belong to the 'WEB' category:
+
+	//book[price > 30 and not(@category='WEB')]
+
+Beginning from the root element, select all title and author elements of
+books in the 'WEB' category, in document order:
+
+	//book[@category='WEB']/title | //book[@category='WEB']/author
+
+Beginning from the root element, select the category attributes of all book
+elements:
+
+	//book/@category
+
+Beginning from the root element, select all book elements whose category
+attribute matches the value bound to the 'category' variable:
+
+	//book[@category=$category]
 */
 type Path struct {
-	segments []segment
+	paths [][]segment    // one segment list per path joined by the union operator
+	x     expr           // expression evaluated instead of paths, if not nil
+	vars  map[string]any // values bound to variables
+}
+
+// PathOptions contains options used to compile a path.
+type PathOptions struct {
+	// Namespaces maps namespace prefixes used within the path to namespace
+	// URIs. If not nil, elements and attributes are matched by namespace
+	// URI and local name rather than by prefix. See CompilePathNS.
+	Namespaces map[string]string
+
+	// Functions contains custom functions that may be called from within
+	// the path's filter expressions, keyed by function name. Custom
+	// functions can't replace the built-in functions.
+	Functions map[string]PathFunc
+}
+
+// A PathFunc is a custom function that may be called from within a path's
+// filter expressions. It is passed the element being evaluated and the
+// results of evaluating each of its arguments. The function may accept any
+// number of arguments. Its return value should be a string, bool, int,
+// float64, *Element, []*Element, []*Attr or PathResult.
+type PathFunc func(e *Element, args []PathResult) any
+
+// A ResultType identifies the type of value produced by evaluating a path.
+type ResultType uint8
+
+const (
+	// NodeSetResult indicates the result is a set of elements, attributes,
+	// text nodes or comments.
+	NodeSetResult ResultType = iota
+
+	// StringResult indicates the result is a string.
+	StringResult
+
+	// NumberResult indicates the result is a number.
+	NumberResult
+
+	// BooleanResult indicates the result is a boolean.
+	BooleanResult
+)
+
+// A PathResult holds the result of evaluating a path. Only the fields
+// corresponding to the result's Type are set. The nodes of a NodeSetResult
+// are kept in the order in which the path selected them.
+type PathResult struct {
+	Type     ResultType
+	Elements []*Element
+	Attrs    []*Attr
+	CharData []*CharData
+	Comments []*Comment
+	String   string
+	Number   float64
+	Boolean  bool
 }
 
 // ErrPath is returned by path functions when an invalid etree path is provided.
@@ -99,15 +265,77 @@ func (err ErrPath) Error() string {
 	return "etree: " + string(err)
 }
 
+// A PathError is returned by CompilePathWithOptions when a path string fails
+// to compile. It wraps the ErrPath describing the error, and its Error method
+// returns the same string as the wrapped ErrPath. It also identifies the
+// location of the error within the path string.
+type PathError struct {
+	Err      ErrPath // the error
+	Path     string  // the path string
+	Offset   int     // byte offset of the error within the path string
+	Segment  string  // the slash-separated segment containing the error
+	Expected string  // description of what was expected, or "" if unknown
+}
+
+// Error returns the string describing a path error.
+func (e *PathError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the ErrPath describing the error.
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
 // CompilePath creates an optimized version of an XPath-like string that
 // can be used to query elements in an element tree.
 func CompilePath(path string) (Path, error) {
-	var comp compiler
-	segments := comp.parsePath(path)
+	return compilePath(path, PathOptions{})
+}
+
+// CompilePathNS creates an optimized version of an XPath-like string in the
+// same way as CompilePath, but resolves the namespace prefixes used within
+// the path using the 'namespaces' map, which maps prefixes to namespace
+// URIs. The compiled path matches elements and attributes by namespace URI
+// and local name rather than by prefix. If the map contains an entry for the
+// empty prefix, unprefixed element names within the path match elements in
+// that namespace; otherwise they match elements in any namespace. An error
+// is returned if the path uses a prefix missing from the map.
+func CompilePathNS(path string, namespaces map[string]string) (Path, error) {
+	return compilePath(path, PathOptions{Namespaces: namespaces})
+}
+
+// compilePath compiles a path in the same way as CompilePathWithOptions,
+// but returns an ErrPath rather than a PathError if the path is invalid.
+func compilePath(path string, opts PathOptions) (Path, error) {
+	p, err := CompilePathWithOptions(path, opts)
+	if pe, ok := err.(*PathError); ok {
+		return p, pe.Err
+	}
+	return p, err
+}
+
+// CompilePathWithOptions creates an optimized version of an XPath-like
+// string in the same way as CompilePath, using the provided options. Unlike
+// CompilePath, it returns a *PathError if the path is invalid, identifying
+// the location of the error within the path string.
+func CompilePathWithOptions(path string, opts PathOptions) (Path, error) {
+	comp := compiler{ns: opts.Namespaces, funcs: opts.Functions}
+	paths, x := comp.parsePath(path)
 	if comp.err != ErrPath("") {
-		return Path{nil}, comp.err
+		return Path{}, comp.pathError(path)
+	}
+	return Path{paths: paths, x: x}, nil
+}
+
+// MustCompilePathNS creates an optimized version of an XPath-like string
+// in the same way as CompilePathNS. Panics if an error occurs.
+func MustCompilePathNS(path string, namespaces map[string]string) Path {
+	p, err := CompilePathNS(path, namespaces)
+	if err != nil {
+		panic(err)
 	}
-	return Path{segments}, nil
+	return p
 }
 
 // MustCompilePath creates an optimized version of an XPath-like string that
@@ -122,6 +350,335 @@ func MustCompilePath(path string) Path {
 	return p
 }
 
+// WithVariables returns a copy of the path in which the variables referred
+// to by the path's filter expressions are bound to the values in 'vars',
+// keyed by variable name without the '$'. Values should be strings, bools,
+// ints, float64s, *Elements, []*Elements, []*Attrs or PathResults. Variables
+// bound by earlier calls are discarded, and variables missing from 'vars'
+// evaluate to an empty set of elements.
+func (path Path) WithVariables(vars map[string]any) Path {
+	path.vars = vars
+	return path
+}
+
+// Evaluate evaluates the path starting from the element 'e' and returns the
+// result. Unlike FindElementsPath, Evaluate supports paths selecting
+// attributes, text nodes and comments, as well as paths consisting of
+// expressions that produce strings, numbers or booleans.
+func (path Path) Evaluate(e *Element) PathResult {
+	if path.x == nil {
+		return PathResult{Type: NodeSetResult, Elements: newPather().traverse(e, path)}
+	}
+	return newPathResult(path.x.eval(&evalContext{e: e, pos: 1, size: 1, vars: path.vars}))
+}
+
+// String returns the path in a normalized form. Compiling the normalized
+// form produces a path equivalent to this one.
+func (path Path) String() string {
+	if path.x != nil {
+		return path.x.String()
+	}
+	parts := make([]string, len(path.paths))
+	for i, segments := range path.paths {
+		parts[i] = segmentsString(segments, "")
+	}
+	return strings.Join(parts, " | ")
+}
+
+// A PathStep describes one step of a compiled location path.
+type PathStep struct {
+	// Axis is the name of the axis along which the step selects elements,
+	// such as "child", "parent", "self" or "descendant-or-self". It is
+	// "root" for the step that begins an absolute path.
+	Axis string
+
+	// Test is the name test elements must pass to be selected. It is a tag,
+	// a prefixed tag, a prefix followed by ":*", or "*". It is empty for
+	// steps selecting elements without a name test, such as "." and "..".
+	Test string
+
+	// Filters contains the normalized form of each of the step's filter
+	// expressions, without their enclosing brackets.
+	Filters []string
+}
+
+// Steps returns the steps of the location paths making up the path. It
+// returns one slice of steps for each location path joined by the union
+// operator. Paths consisting of an expression other than location paths
+// have no steps, and Steps returns nil.
+func (path Path) Steps() [][]PathStep {
+	if path.x != nil {
+		return nil
+	}
+	steps := make([][]PathStep, len(path.paths))
+	for i, segments := range path.paths {
+		for _, seg := range segments {
+			var step PathStep
+			switch sel := seg.sel.(type) {
+			case *selectRoot:
+				step.Axis = "root"
+			case *selectSelf:
+				step.Axis = "self"
+			case *selectParent:
+				step.Axis = "parent"
+			case *selectDescendants:
+				step.Axis = "descendant-or-self"
+			case *selectChildren:
+				step.Axis, step.Test = "child", "*"
+			case *selectChildrenByTag:
+				step.Axis, step.Test = "child", sel.String()
+			case *selectAxis:
+				step.Axis, step.Test = sel.axis, sel.test()
+			}
+			for _, f := range seg.filters {
+				step.Filters = append(step.Filters, f.String())
+			}
+			steps[i] = append(steps[i], step)
+		}
+	}
+	return steps
+}
+
+// Matches returns true if the element 'e' would be selected by evaluating
+// the path from the root of e's element tree, typically its document. For
+// most paths, Matches works backward from the element toward the root, and
+// doesn't need to search the rest of the tree.
+func (path Path) Matches(e *Element) bool {
+	root := e
+	for root.parent != nil {
+		root = root.parent
+	}
+
+	if path.x == nil {
+		matched, ok := false, true
+		for _, segments := range path.paths {
+			m, k := matchSegments(root, e, segments, path.vars)
+			matched, ok = matched || m, ok && k
+		}
+		if matched || ok {
+			return matched
+		}
+	}
+
+	found := false
+	newPather().walk(root, path, func(r *Element) bool {
+		found = r == e
+		return !found
+	})
+	return found
+}
+
+// matchSegments returns true if applying the segments to the element 'from'
+// selects the element 'e'. It works backward from the last segment. If the
+// segments contain selectors that can't be applied backward, it returns
+// false for 'ok'.
+func matchSegments(from, e *Element, segments []segment, vars map[string]any) (matched, ok bool) {
+	if len(segments) == 0 {
+		return e == from, true
+	}
+
+	seg, rest := segments[len(segments)-1], segments[:len(segments)-1]
+	switch seg.sel.(type) {
+	case *selectChildren, *selectChildrenByTag:
+		if e.parent == nil || !seg.selects(e.parent, e, vars) {
+			return false, true
+		}
+		return matchSegments(from, e.parent, rest, vars)
+
+	case *selectSelf:
+		if !seg.selects(e, e, vars) {
+			return false, true
+		}
+		return matchSegments(from, e, rest, vars)
+
+	case *selectRoot:
+		if e.parent != nil || !seg.selects(e, e, vars) {
+			return false, true
+		}
+		return len(rest) == 0, len(rest) == 0
+
+	case *selectDescendants:
+		if len(seg.filters) > 0 {
+			return false, false
+		}
+		for a := e; a != nil; a = a.parent {
+			if m, ok := matchSegments(from, a, rest, vars); m || !ok {
+				return m, ok
+			}
+		}
+		return false, true
+
+	default:
+		return false, false
+	}
+}
+
+// selects returns true if applying the segment to the element 'from'
+// selects the element 'e'.
+func (seg *segment) selects(from, e *Element, vars map[string]any) bool {
+	p := newPather()
+	p.vars = vars
+	seg.apply(from, p)
+	for _, c := range p.candidates {
+		if c == e {
+			return true
+		}
+	}
+	return false
+}
+
+// ensure returns the first element matched by the path from the element e,
+// creating any missing elements along the way. It returns nil and leaves
+// the tree unchanged if the path can't be satisfied by creating elements.
+func (path Path) ensure(e *Element) *Element {
+	if path.x != nil || len(path.paths) != 1 {
+		return nil
+	}
+	return ensureSegments(e, path.paths[0], path.vars)
+}
+
+// setValue ensures the path from the element e and sets the value of the
+// element it selects. If the path ends in an attribute or a text() node
+// test, the attribute's value or the element's text is set instead. It
+// returns the element whose value was set, or nil if the path can't be
+// ensured.
+func (path Path) setValue(e *Element, value string) *Element {
+	x, ok := path.x.(*exprPath)
+	if !ok {
+		if e = path.ensure(e); e != nil {
+			e.SetText(value)
+		}
+		return e
+	}
+
+	if (x.attr == nil && x.node != "text") || (x.attr != nil && x.attr.key == "*") {
+		return nil
+	}
+	if e = ensureSegments(e, x.segments, path.vars); e == nil {
+		return nil
+	}
+	if x.attr != nil {
+		e.CreateAttr(spaceCompose(x.attr.space, x.attr.key), value)
+	} else {
+		e.SetText(value)
+	}
+	return e
+}
+
+// ensureSegments follows the path segments from the element e. At each step,
+// it returns the first element matched by the rest of the path, if there is
+// one. Otherwise it moves to the first element selected by the step,
+// creating it if necessary.
+func ensureSegments(e *Element, segments []segment, vars map[string]any) *Element {
+	var created []*Element
+	for i := range segments {
+		var found *Element
+		rest := Path{paths: [][]segment{segments[i:]}, vars: vars}
+		newPather().walk(e, rest, func(c *Element) bool {
+			found = c
+			return false
+		})
+		if found != nil {
+			return found
+		}
+
+		p := newPather()
+		p.vars = vars
+		segments[i].apply(e, p)
+		if len(p.candidates) > 0 {
+			e = p.candidates[0]
+			continue
+		}
+
+		c := segments[i].create(e, vars)
+		if len(c) == 0 {
+			// Undo the changes made so far.
+			for j := len(created) - 1; j >= 0; j-- {
+				created[j].Parent().RemoveChild(created[j])
+			}
+			return nil
+		}
+		created = append(created, c...)
+		e = c[len(c)-1]
+	}
+	return e
+}
+
+// create adds to the element 'parent' the child elements needed for the
+// segment to select an element, and returns them. Only child selectors
+// with a tag can be satisfied this way, and only when all of their filters
+// are attribute, child element or text() tests, optionally followed by a
+// position. It returns nil if the segment can't be satisfied.
+func (seg *segment) create(parent *Element, vars map[string]any) []*Element {
+	var space, tag string
+	switch s := seg.sel.(type) {
+	case *selectChildrenByTag:
+		space, tag = s.space, s.tag
+	case *selectAxis:
+		if s.axis != "child" {
+			return nil
+		}
+		space, tag = s.space, s.tag
+	}
+	if tag == "" || tag == "*" {
+		return nil
+	}
+
+	// A trailing position filter requires enough matching siblings to
+	// select the element at that position.
+	filters, count := seg.filters, 1
+	if n := len(filters); n > 0 {
+		if f, ok := filters[n-1].(*filterPos); ok {
+			if f.index < 0 {
+				return nil
+			}
+			filters = filters[:n-1]
+			p := newPather()
+			p.vars = vars
+			(&segment{seg.sel, filters}).apply(parent, p)
+			count = f.index + 1 - len(p.candidates)
+		}
+	}
+
+	var created []*Element
+	undo := func() []*Element {
+		for _, c := range created {
+			parent.RemoveChild(c)
+		}
+		return nil
+	}
+
+	for ; count > 0; count-- {
+		c := parent.CreateElement(spaceCompose(space, tag))
+		created = append(created, c)
+		for _, f := range filters {
+			switch f := f.(type) {
+			case *filterAttr:
+				c.CreateAttr(spaceCompose(f.space, f.key), "")
+			case *filterAttrVal:
+				c.CreateAttr(spaceCompose(f.space, f.key), f.val)
+			case *filterChild:
+				c.CreateElement(spaceCompose(f.space, f.tag))
+			case *filterChildText:
+				c.CreateElement(spaceCompose(f.space, f.tag)).SetText(f.text)
+			case *filterFuncVal:
+				if f.name != "text" {
+					return undo()
+				}
+				c.SetText(f.val)
+			default:
+				return undo()
+			}
+		}
+	}
+
+	// Conflicting filters may still reject the created element.
+	if len(created) == 0 || !seg.selects(parent, created[len(created)-1], vars) {
+		return undo()
+	}
+	return created
+}
+
 // A segment is a portion of a path between "/" characters.
 // It contains one selector and zero or more [filters].
 type segment struct {
@@ -136,22 +693,55 @@ func (seg *segment) apply(e *Element, p *pather) {
 	}
 }
 
+// String returns the path segment in normalized form.
+func (seg *segment) String() string {
+	var b strings.Builder
+	b.WriteString(seg.sel.String())
+	for _, f := range seg.filters {
+		b.WriteString("[" + f.String() + "]")
+	}
+	return b.String()
+}
+
+// segmentsString returns the normalized form of a location path consisting
+// of the segments followed by the optional 'last' step.
+func segmentsString(segments []segment, last string) string {
+	if len(segments) == 1 && last == "" {
+		if _, ok := segments[0].sel.(*selectRoot); ok {
+			return "/"
+		}
+	}
+	var parts []string
+	for i := range segments {
+		parts = append(parts, segments[i].String())
+	}
+	if last != "" {
+		parts = append(parts, last)
+	}
+	return strings.Join(parts, "/")
+}
+
 // A selector selects XML elements for consideration by the
 // path traversal.
 type selector interface {
 	apply(e *Element, p *pather)
+	String() string
 }
 
 // A filter pares down a list of candidate XML elements based
 // on a path filter in [brackets].
 type filter interface {
 	apply(p *pather)
+	String() string
 }
 
 // A pather is helper object that traverses an element tree using
 // a Path object.  It collects and deduplicates all elements matching
 // the path query.
 type pather struct {
+	vars       map[string]any        // values bound to variables
+	yield      func(e *Element) bool // called for each result, if not nil
+	stopped    bool                  // true once yield has returned false
 	queue      queue[node]
 	results    []*Element
 	inResults  map[*Element]bool
@@ -160,10 +750,15 @@ type pather struct {
 }
 
 // A node represents an element and the remaining path segments that
-// should be applied against it by the pather.
+// should be applied against it by the pather. A node with a descendants
+// queue instead represents a series of nodes, one for each element of a
+// breadth-first walk starting from the queued elements. These nodes are
+// expanded one at a time, so that a walk ending early avoids visiting the
+// rest of the tree.
 type node struct {
-	e        *Element
-	segments []segment
+	e           *Element
+	segments    []segment
+	descendants *queue[*Element]
 }
 
 func newPather() *pather {
@@ -177,189 +772,864 @@ func newPather() *pather {
 
 // traverse follows the path from the element e, collecting
 // and then returning all elements that match the path's selectors
-// and filters.
+// and filters. The results of a union of paths are returned in
+// document order.
 func (p *pather) traverse(e *Element, path Path) []*Element {
-	for p.queue.add(node{e, path.segments}); p.queue.len() > 0; {
-		p.eval(p.queue.remove())
-	}
+	p.walk(e, path, nil)
 	return p.results
 }
 
+// walk follows the path from the element e, passing each element that
+// matches the path to the yield function as soon as it is found. The walk
+// ends early if yield returns false. Because the results of a union of
+// paths are returned in document order, they are all found before any of
+// them is passed to yield.
+func (p *pather) walk(e *Element, path Path, yield func(e *Element) bool) {
+	p.vars = path.vars
+	if path.x == nil && len(path.paths) == 1 {
+		p.yield = yield
+		p.run(node{e: e, segments: path.paths[0]})
+		return
+	}
+
+	if path.x != nil {
+		n, _ := path.x.eval(&evalContext{e: e, pos: 1, size: 1, vars: path.vars}).(nodeSet)
+		for _, c := range n.elements {
+			p.addResult(c)
+		}
+	} else {
+		for _, segments := range path.paths {
+			p.run(node{e: e, segments: segments})
+		}
+		sortDocumentOrder(p.results)
+	}
+
+	if yield != nil {
+		for _, c := range p.results {
+			if !yield(c) {
+				break
+			}
+		}
+	}
+}
+
+// run evaluates path nodes, starting with the node n, until there are
+// no more nodes to evaluate or the walk has ended.
+func (p *pather) run(n node) {
+	for p.queue.add(n); p.queue.len() > 0 && !p.stopped; {
+		n := p.queue.peek()
+		if n.descendants == nil {
+			p.eval(p.queue.remove())
+			continue
+		}
+
+		e := n.descendants.remove()
+		for _, c := range e.Child {
+			if c, ok := c.(*Element); ok {
+				n.descendants.add(c)
+			}
+		}
+		if n.descendants.len() == 0 {
+			p.queue.remove()
+		}
+		p.eval(node{e: e, segments: n.segments})
+	}
+}
+
 // eval evaluates the current path node by applying the remaining
 // path's selector rules against the node's element.
 func (p *pather) eval(n node) {
-	p.candidates = p.candidates[0:0]
 	seg, remain := n.segments[0], n.segments[1:]
+
+	// Unfiltered descendants are selected one at a time.
+	if _, ok := seg.sel.(*selectDescendants); ok && len(seg.filters) == 0 {
+		descendants := new(queue[*Element])
+		descendants.add(n.e)
+		if len(remain) > 0 {
+			p.queue.add(node{segments: remain, descendants: descendants})
+			return
+		}
+		for descendants.len() > 0 && !p.stopped {
+			e := descendants.remove()
+			for _, c := range e.Child {
+				if c, ok := c.(*Element); ok {
+					descendants.add(c)
+				}
+			}
+			p.addResult(e)
+		}
+		return
+	}
+
+	p.candidates = p.candidates[0:0]
 	seg.apply(n.e, p)
 
 	if len(remain) == 0 {
 		for _, c := range p.candidates {
-			if in := p.inResults[c]; !in {
-				p.inResults[c] = true
-				p.results = append(p.results, c)
+			if p.addResult(c); p.stopped {
+				break
 			}
 		}
 	} else {
 		for _, c := range p.candidates {
-			p.queue.add(node{c, remain})
+			p.queue.add(node{e: c, segments: remain})
 		}
 	}
 }
 
+// addResult adds the element e to the results, unless it is already one
+// of the results, and passes it to the yield function.
+func (p *pather) addResult(e *Element) {
+	if in := p.inResults[e]; in {
+		return
+	}
+	p.inResults[e] = true
+	p.results = append(p.results, e)
+	if p.yield != nil && !p.yield(e) {
+		p.stopped = true
+	}
+}
+
+// sortDocumentOrder sorts elements belonging to the same element tree into
+// document order.
+func sortDocumentOrder(elements []*Element) {
+	keys := make(map[*Element][]int, len(elements))
+	for _, e := range elements {
+		var key []int
+		for a := e; a.parent != nil; a = a.parent {
+			key = append(key, a.index)
+		}
+		slices.Reverse(key)
+		keys[e] = key
+	}
+	slices.SortStableFunc(elements, func(a, b *Element) int {
+		return slices.Compare(keys[a], keys[b])
+	})
+}
+
+var fnTable = map[string]func(e *Element) string{
+	"local-name":       (*Element).name,
+	"name":             (*Element).FullTag,
+	"namespace-prefix": (*Element).namespacePrefix,
+	"namespace-uri":    (*Element).NamespaceURI,
+	"text":             (*Element).Text,
+}
+
 // A compiler generates a compiled path from a path string.
 type compiler struct {
-	err ErrPath
+	err      ErrPath
+	offset   int                 // byte offset of the error within the path string
+	expected string              // description of what was expected at the error
+	ns       map[string]string   // namespace prefix to URI map, if any
+	funcs    map[string]PathFunc // custom functions, if any
+	tokens   []pathToken         // tokens lexed from the path string
+	pos      int                 // index of the next token to be parsed
 }
 
-// parsePath parses an XPath-like string describing a path
-// through an element tree and returns a slice of segment
-// descriptors.
-func (c *compiler) parsePath(path string) []segment {
+// parsePath parses an XPath-like string describing one or more
+// paths through an element tree and returns a slice of segment
+// descriptors for each path. If the string doesn't describe paths
+// selecting only elements, it is parsed as an expression instead.
+func (c *compiler) parsePath(path string) ([][]segment, expr) {
 	// If path ends with //, fix it
 	if strings.HasSuffix(path, "//") {
 		path += "*"
 	}
 
-	var segments []segment
+	c.tokens = c.lex(path)
+	if c.err != ErrPath("") {
+		return nil, nil
+	}
 
-	// Check for an absolute path
-	if strings.HasPrefix(path, "/") {
-		segments = append(segments, segment{new(selectRoot), []filter{}})
-		path = path[1:]
+	paths := c.parseLocationPaths()
+	if c.err == ErrPath("") {
+		return paths, nil
+	}
+
+	// Report the error of whichever parse got further, preferring the
+	// location path error.
+	saved := *c
+	c.err, c.pos = ErrPath(""), 0
+	x := c.parseExpr()
+	if c.err == ErrPath("") && c.peek().kind != tokEOF {
+		c.unexpected(c.peek(), "the end of the path")
+	}
+	if c.err != ErrPath("") && c.pos <= saved.pos {
+		c.err, c.offset, c.expected = saved.err, saved.offset, saved.expected
+	}
+	return nil, x
+}
+
+// fail records the error 'err' found at byte offset 'offset' of the path
+// string. The 'expected' string describes what was expected instead, if
+// known.
+func (c *compiler) fail(err ErrPath, offset int, expected string) {
+	c.err, c.offset, c.expected = err, offset, expected
+}
+
+// pathError returns a PathError describing the recorded error in the path
+// string.
+func (c *compiler) pathError(path string) *PathError {
+	offset := min(c.offset, len(path))
+	return &PathError{
+		Err:      c.err,
+		Path:     path,
+		Offset:   offset,
+		Segment:  pathSegment(path, offset),
+		Expected: c.expected,
+	}
+}
+
+// pathSegment returns the slash-separated segment of the path string
+// containing the byte offset. Slashes within filter brackets and quoted
+// strings don't separate segments.
+func pathSegment(path string, offset int) string {
+	start, depth := 0, 0
+	var quote byte
+	for i := 0; i < len(path); i++ {
+		ch := path[i]
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '[':
+			depth++
+		case ch == ']' && depth > 0:
+			depth--
+		case (ch == '/' || ch == '|') && depth == 0:
+			if i >= offset {
+				return strings.TrimSpace(path[start:i])
+			}
+			start = i + 1
+		}
 	}
+	return strings.TrimSpace(path[start:])
+}
 
-	// Split path into segments
-	for _, s := range splitPath(path) {
-		segments = append(segments, c.parseSegment(s))
-		if c.err != ErrPath("") {
+// parseLocationPaths parses one or more location paths joined by the
+// union operator.
+func (c *compiler) parseLocationPaths() [][]segment {
+	paths := [][]segment{c.parseLocationPath()}
+	for c.err == ErrPath("") && c.peekOp("|") {
+		c.next()
+		if t := c.peek(); t.kind == tokEOF || t.isOp("|") {
+			c.unexpected(t, "a path")
 			break
 		}
+		paths = append(paths, c.parseLocationPath())
+	}
+	if c.err == ErrPath("") && c.peek().kind != tokEOF {
+		c.unexpected(c.peek(), "the end of the path")
 	}
-	return segments
+	return paths
 }
 
-func splitPath(path string) []string {
-	var pieces []string
-	start := 0
-	inquote := false
-	var quote byte
-	for i := 0; i+1 <= len(path); i++ {
-		if !inquote {
-			if path[i] == '\'' || path[i] == '"' {
-				inquote, quote = true, path[i]
-			} else if path[i] == '/' {
-				pieces = append(pieces, path[start:i])
-				start = i + 1
+// parseLocationPath parses a series of slash-separated path segments. As
+// with the path's string form, an empty segment selects all descendants.
+func (c *compiler) parseLocationPath() []segment {
+	var segments []segment
+
+	// Check for an absolute path
+	if c.peekOp("/") {
+		c.next()
+		segments = append(segments, segment{new(selectRoot), []filter{}})
+	}
+
+	for {
+		if c.peekStep() {
+			seg := c.parseStep()
+			if c.err != ErrPath("") {
+				return segments
 			}
-		} else if path[i] == quote {
-			inquote = false
+			segments = append(segments, seg)
+		} else {
+			segments = append(segments, segment{new(selectDescendants), []filter{}})
+		}
+
+		if !c.peekOp("/") {
+			return segments
 		}
+		c.next()
 	}
-	return append(pieces, path[start:])
 }
 
-// parseSegment parses a path segment between / characters.
-func (c *compiler) parseSegment(path string) segment {
-	pieces := strings.Split(path, "[")
+// parseStep parses a path segment's selector and all of its filters.
+func (c *compiler) parseStep() segment {
 	seg := segment{
-		sel:     c.parseSelector(pieces[0]),
+		sel:     c.parseSelector(c.next()),
 		filters: []filter{},
 	}
-	for i := 1; i < len(pieces); i++ {
-		fpath := pieces[i]
-		if len(fpath) == 0 || fpath[len(fpath)-1] != ']' {
-			c.err = ErrPath("path has invalid filter [brackets].")
-			break
+	for c.err == ErrPath("") && c.peekOp("[") {
+		f := c.parseFilter()
+		if c.err == ErrPath("") {
+			seg.filters = append(seg.filters, f)
 		}
-		seg.filters = append(seg.filters, c.parseFilter(fpath[:len(fpath)-1]))
 	}
 	return seg
 }
 
 // parseSelector parses a selector at the start of a path segment.
-func (c *compiler) parseSelector(path string) selector {
-	switch path {
-	case ".":
+func (c *compiler) parseSelector(t pathToken) selector {
+	switch {
+	case t.isOp("."):
 		return new(selectSelf)
-	case "..":
+	case t.isOp(".."):
 		return new(selectParent)
-	case "*":
+	case t.isOp("*"):
 		return new(selectChildren)
-	case "":
-		return new(selectDescendants)
+	case c.peekOp("::"):
+		return c.parseAxis(t)
 	default:
-		return newSelectChildrenByTag(path)
+		s := newSelectChildrenByTag(t.text)
+		s.spaceTest = c.resolveSpace(s.space, false, t.offset)
+		return s
 	}
 }
 
-var fnTable = map[string]func(e *Element) string{
-	"local-name":       (*Element).name,
-	"name":             (*Element).FullTag,
-	"namespace-prefix": (*Element).namespacePrefix,
-	"namespace-uri":    (*Element).NamespaceURI,
-	"text":             (*Element).Text,
+// parseAxis parses an axis selector of the form axis::tag.
+func (c *compiler) parseAxis(t pathToken) selector {
+	if _, ok := axisTable[t.text]; !ok {
+		c.fail(ErrPath("path has unknown axis "+t.text), t.offset, "")
+		return nil
+	}
+	c.next()
+	test := c.next()
+	if test.kind != tokName && !test.isOp("*") {
+		c.unexpected(test, "an element name or '*'")
+		return nil
+	}
+	s := newSelectAxis(t.text, test.text)
+	s.spaceTest = c.resolveSpace(s.space, false, test.offset)
+	return s
+}
+
+// resolveSpace returns a test matching the namespace prefix 'space' of an
+// element or attribute name. If the path is compiled with a namespace map,
+// the prefix is resolved to a namespace URI. Unprefixed attribute names are
+// never resolved, since attributes don't belong to the default namespace.
+// The name's byte offset within the path string is used to report errors.
+func (c *compiler) resolveSpace(space string, attr bool, offset int) spaceTest {
+	if c.ns == nil || (space == "" && attr) {
+		return spaceTest{space: space}
+	}
+	uri, ok := c.ns[space]
+	switch {
+	case ok:
+		return spaceTest{space, uri, true}
+	case space == "":
+		return spaceTest{}
+	default:
+		c.fail(ErrPath("path has undeclared namespace prefix "+space), offset, "")
+		return spaceTest{}
+	}
 }
 
 // parseFilter parses a path filter contained within [brackets].
-func (c *compiler) parseFilter(path string) filter {
-	if len(path) == 0 {
-		c.err = ErrPath("path contains an empty filter expression.")
+func (c *compiler) parseFilter() filter {
+	open := c.next()
+	if c.peekOp("]") {
+		c.fail(ErrPath("path contains an empty filter expression."), open.offset, "an expression")
 		return nil
 	}
 
-	// Filter contains [@attr='val'], [@attr="val"], [fn()='val'],
-	// [fn()="val"], [tag='val'] or [tag="val"]?
-	eqindex := strings.IndexByte(path, '=')
-	if eqindex >= 0 && eqindex+1 < len(path) {
-		quote := path[eqindex+1]
-		if quote == '\'' || quote == '"' {
-			rindex := nextIndex(path, quote, eqindex+2)
-			if rindex != len(path)-1 {
-				c.err = ErrPath("path has mismatched filter quotes.")
+	e := c.parseExpr()
+	if c.err != ErrPath("") {
+		return nil
+	}
+	if !c.peekOp("]") {
+		if t := c.peek(); t.kind == tokEOF {
+			c.fail(ErrPath("path has invalid filter [brackets]."), t.offset, "']'")
+		} else {
+			c.unexpected(t, "']'")
+		}
+		return nil
+	}
+	c.next()
+	return newFilter(e)
+}
+
+// parseExpr parses a filter expression.
+func (c *compiler) parseExpr() expr {
+	return c.parseOr()
+}
+
+// parseOr parses a series of expressions joined by the "or" operator.
+func (c *compiler) parseOr() expr {
+	e := c.parseAnd()
+	for c.err == ErrPath("") && c.peekName("or") {
+		c.next()
+		e = &exprBinary{"or", e, c.parseAnd()}
+	}
+	return e
+}
+
+// parseAnd parses a series of expressions joined by the "and" operator.
+func (c *compiler) parseAnd() expr {
+	e := c.parseEquality()
+	for c.err == ErrPath("") && c.peekName("and") {
+		c.next()
+		e = &exprBinary{"and", e, c.parseEquality()}
+	}
+	return e
+}
+
+// parseEquality parses a series of expressions joined by the = and !=
+// operators.
+func (c *compiler) parseEquality() expr {
+	e := c.parseRelational()
+	for c.err == ErrPath("") && (c.peekOp("=") || c.peekOp("!=")) {
+		op := c.next().text
+		e = &exprBinary{op, e, c.parseRelational()}
+	}
+	return e
+}
+
+// parseRelational parses a series of expressions joined by the <, <=, >
+// and >= operators.
+func (c *compiler) parseRelational() expr {
+	e := c.parseAdditive()
+	for c.err == ErrPath("") &&
+		(c.peekOp("<") || c.peekOp("<=") || c.peekOp(">") || c.peekOp(">=")) {
+		op := c.next().text
+		e = &exprBinary{op, e, c.parseAdditive()}
+	}
+	return e
+}
+
+// parseAdditive parses a series of expressions joined by the + and -
+// operators.
+func (c *compiler) parseAdditive() expr {
+	e := c.parseMultiplicative()
+	for c.err == ErrPath("") && (c.peekOp("+") || c.peekOp("-")) {
+		op := c.next().text
+		e = &exprBinary{op, e, c.parseMultiplicative()}
+	}
+	return e
+}
+
+// parseMultiplicative parses a series of expressions joined by the *, div
+// and mod operators. An asterisk following an operand is always a
+// multiplication operator.
+func (c *compiler) parseMultiplicative() expr {
+	e := c.parseUnary()
+	for c.err == ErrPath("") && (c.peekOp("*") || c.peekName("div") || c.peekName("mod")) {
+		op := c.next().text
+		e = &exprBinary{op, e, c.parseUnary()}
+	}
+	return e
+}
+
+// parseUnary parses an expression optionally preceded by a minus sign.
+func (c *compiler) parseUnary() expr {
+	if !c.peekOp("-") {
+		return c.parseUnion()
+	}
+	c.next()
+	e := c.parseUnary()
+	if n, ok := e.(*exprNumber); ok {
+		return &exprNumber{-n.val}
+	}
+	return &exprNegate{e}
+}
+
+// parseUnion parses a series of location paths joined by the | operator.
+func (c *compiler) parseUnion() expr {
+	start := c.pos
+	e := c.parsePrimary()
+	if c.err != ErrPath("") || !c.peekOp("|") {
+		return e
+	}
+
+	u := &exprUnion{[]expr{e}}
+	offsets := []int{c.tokens[start].offset}
+	for c.err == ErrPath("") && c.peekOp("|") {
+		c.next()
+		offsets = append(offsets, c.peek().offset)
+		u.paths = append(u.paths, c.parsePrimary())
+	}
+	if c.err != ErrPath("") {
+		return nil
+	}
+	for i, p := range u.paths {
+		switch p.(type) {
+		case *exprPath, *exprUnion, *exprVar:
+		default:
+			c.fail(ErrPath("path has union of non-path expressions."), offsets[i], "a path")
+			return nil
+		}
+	}
+	return u
+}
+
+// parsePrimary parses a literal, number, function call, parenthesized
+// expression or location path.
+func (c *compiler) parsePrimary() expr {
+	t := c.peek()
+	switch {
+	case t.kind == tokLiteral:
+		c.next()
+		return &exprLiteral{t.text}
+	case t.kind == tokNumber:
+		c.next()
+		v, _ := strconv.ParseFloat(t.text, 64)
+		return &exprNumber{v}
+	case t.isOp("("):
+		c.next()
+		e := c.parseExpr()
+		if c.err == ErrPath("") && !c.expectOp(")") {
+			return nil
+		}
+		return e
+	case t.kind == tokName && c.peekAt(1).isOp("("):
+		return c.parseCall()
+	case t.isOp("$"):
+		c.next()
+		name := c.next()
+		if name.kind != tokName {
+			c.unexpected(name, "a variable name")
+			return nil
+		}
+		return &exprVar{name.text}
+	case c.peekStep() || t.isOp("@") || t.isOp("/"):
+		return c.parsePathExpr()
+	case t.kind == tokEOF:
+		c.fail(ErrPath("path has invalid filter [brackets]."), t.offset, "an expression")
+		return nil
+	default:
+		c.unexpected(t, "an expression")
+		return nil
+	}
+}
+
+// parseCall parses a function call.
+func (c *compiler) parseCall() expr {
+	t := c.next()
+	name := t.text
+	c.next()
+
+	var args []expr
+	if !c.peekOp(")") {
+		for {
+			args = append(args, c.parseExpr())
+			if c.err != ErrPath("") {
 				return nil
 			}
+			if !c.peekOp(",") {
+				break
+			}
+			c.next()
+		}
+	}
+	if !c.expectOp(")") {
+		return nil
+	}
 
-			key := path[:eqindex]
-			value := path[eqindex+2 : rindex]
+	fn, ok := functions[name]
+	if !ok {
+		custom, ok := c.funcs[name]
+		if !ok {
+			c.fail(ErrPath("path has unknown function "+name), t.offset, "")
+			return nil
+		}
+		fn = customFunction(custom)
+	}
+	if len(args) < fn.minArgs || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+		c.fail(ErrPath("path has wrong number of arguments for function "+name), t.offset, "")
+		return nil
+	}
+	return &exprCall{name, fn, args}
+}
 
-			switch {
-			case key[0] == '@':
-				return newFilterAttrVal(key[1:], value)
-			case strings.HasSuffix(key, "()"):
-				name := key[:len(key)-2]
-				if fn, ok := fnTable[name]; ok {
-					return newFilterFuncVal(fn, value)
-				}
-				c.err = ErrPath("path has unknown function " + name)
+// parsePathExpr parses a location path used within a filter expression. The
+// path may end with an attribute selector (@attrib).
+func (c *compiler) parsePathExpr() expr {
+	p := &exprPath{}
+
+	if c.peekOp("/") {
+		c.next()
+		p.segments = append(p.segments, segment{new(selectRoot), []filter{}})
+		if !c.peekStep() && !c.peekOp("@") && !c.peekOp("/") && !c.peekNodeTest() {
+			return p
+		}
+	}
+
+	for {
+		switch {
+		case c.peekNodeTest():
+			p.node = c.next().text
+			c.next()
+			c.next()
+			return p
+		case c.peekOp("@"):
+			c.next()
+			t := c.next()
+			if t.kind != tokName && !t.isOp("*") {
+				c.unexpected(t, "an attribute name or '*'")
 				return nil
-			default:
-				return newFilterChildText(key, value)
 			}
+			space, key := spaceDecompose(t.text)
+			p.attr = &attrTest{c.resolveSpace(space, true, t.offset), key}
+			return p
+		case c.peekStep():
+			seg := c.parseStep()
+			if c.err != ErrPath("") {
+				return nil
+			}
+			p.segments = append(p.segments, seg)
+		default:
+			p.segments = append(p.segments, segment{new(selectDescendants), []filter{}})
+		}
+
+		if !c.peekOp("/") {
+			return p
 		}
+		c.next()
+	}
+}
+
+// peek returns the next token without consuming it.
+func (c *compiler) peek() pathToken {
+	return c.tokens[c.pos]
+}
+
+// peekAt returns the token 'n' tokens beyond the next token without
+// consuming any tokens.
+func (c *compiler) peekAt(n int) pathToken {
+	if c.pos+n < len(c.tokens) {
+		return c.tokens[c.pos+n]
 	}
+	return c.tokens[len(c.tokens)-1]
+}
 
-	// Filter contains [@attr], [N], [tag] or [fn()]
+// peekOp returns true if the next token is the operator 'op'.
+func (c *compiler) peekOp(op string) bool {
+	return c.peek().isOp(op)
+}
+
+// peekName returns true if the next token is the name 'name'.
+func (c *compiler) peekName(name string) bool {
+	t := c.peek()
+	return t.kind == tokName && t.text == name
+}
+
+// peekStep returns true if the next token begins a path segment.
+func (c *compiler) peekStep() bool {
+	t := c.peek()
 	switch {
-	case path[0] == '@':
-		return newFilterAttr(path[1:])
-	case strings.HasSuffix(path, "()"):
-		name := path[:len(path)-2]
-		if fn, ok := fnTable[name]; ok {
-			return newFilterFunc(fn)
-		}
-		c.err = ErrPath("path has unknown function " + name)
-		return nil
-	case isInteger(path):
-		pos, _ := strconv.Atoi(path)
+	case t.kind == tokName:
+		return !c.peekAt(1).isOp("(")
+	default:
+		return t.isOp(".") || t.isOp("..") || t.isOp("*")
+	}
+}
+
+// peekNodeTest returns true if the next tokens form a text() or comment()
+// node test.
+func (c *compiler) peekNodeTest() bool {
+	return (c.peekName("text") || c.peekName("comment")) &&
+		c.peekAt(1).isOp("(") && c.peekAt(2).isOp(")")
+}
+
+// next consumes and returns the next token.
+func (c *compiler) next() pathToken {
+	t := c.tokens[c.pos]
+	if c.pos < len(c.tokens)-1 {
+		c.pos++
+	}
+	return t
+}
+
+// expectOp consumes the next token if it is the operator 'op'. Otherwise,
+// it records an error and returns false.
+func (c *compiler) expectOp(op string) bool {
+	if !c.peekOp(op) {
+		c.unexpected(c.peek(), "'"+op+"'")
+		return false
+	}
+	c.next()
+	return true
+}
+
+// unexpected records an error describing the unexpected token 't'. The
+// 'expected' string describes what was expected instead.
+func (c *compiler) unexpected(t pathToken, expected string) {
+	switch {
+	case t.isOp("[") || t.isOp("]") || (c.pos > 0 && c.tokens[c.pos-1].isOp("]")):
+		c.fail(ErrPath("path has invalid filter [brackets]."), t.offset, expected)
+	case t.kind == tokEOF:
+		c.fail(ErrPath("path ends unexpectedly."), t.offset, expected)
+	default:
+		c.fail(ErrPath("path has unexpected '"+t.source()+"'."), t.offset, expected)
+	}
+}
+
+// A pathTokenKind identifies the type of a token lexed from a path string.
+type pathTokenKind uint8
+
+const (
+	tokEOF     pathTokenKind = iota
+	tokName                  // element or attribute name, or function name
+	tokLiteral               // quoted string literal, without its quotes
+	tokNumber                // numeric literal
+	tokOp                    // operator or punctuation
+)
+
+// A pathToken is a token lexed from a path string.
+type pathToken struct {
+	kind   pathTokenKind
+	text   string
+	offset int // byte offset of the token within the path string
+}
+
+// isOp returns true if the token is the operator 'op'.
+func (t pathToken) isOp(op string) bool {
+	return t.kind == tokOp && t.text == op
+}
+
+// source returns the token as it appeared in the path string.
+func (t pathToken) source() string {
+	if t.kind == tokLiteral {
+		return "'" + t.text + "'"
+	}
+	return t.text
+}
+
+// pathOps contains all operators and punctuation recognized in path strings,
+// with multi-character operators listed first.
+var pathOps = []string{
+	"..", "!=", "<=", ">=", "::",
+	"/", "[", "]", "(", ")", "@", ",", ".", "*", "=", "<", ">", "+", "-", "|", "$",
+}
+
+// lex splits the path string into tokens. The last token is always tokEOF.
+func (c *compiler) lex(path string) []pathToken {
+	var tokens []pathToken
+	i := 0
+loop:
+	for i < len(path) {
+		ch := path[i]
 		switch {
-		case pos > 0:
-			return newFilterPos(pos - 1)
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+
+		case ch == '\'' || ch == '"':
+			end := nextIndex(path, ch, i+1)
+			if end < 0 {
+				c.fail(ErrPath("path has mismatched filter quotes."), i, "a closing quote")
+				return nil
+			}
+			tokens = append(tokens, pathToken{tokLiteral, path[i+1 : end], i})
+			i = end + 1
+
+		case isDigit(ch) || (ch == '.' && i+1 < len(path) && isDigit(path[i+1])):
+			j := i
+			for j < len(path) && isDigit(path[j]) {
+				j++
+			}
+			if j < len(path) && path[j] == '.' {
+				for j++; j < len(path) && isDigit(path[j]); j++ {
+				}
+			}
+			tokens = append(tokens, pathToken{tokNumber, path[i:j], i})
+			i = j
+
+		case isNameStart(ch):
+			j := scanName(path, i)
+			if j+1 < len(path) && path[j] == ':' && path[j+1] != ':' {
+				switch {
+				case path[j+1] == '*':
+					j += 2
+				case isNameStart(path[j+1]):
+					j = scanName(path, j+1)
+				}
+			}
+			tokens = append(tokens, pathToken{tokName, path[i:j], i})
+			i = j
+
 		default:
-			return newFilterPos(pos)
+			for _, op := range pathOps {
+				if strings.HasPrefix(path[i:], op) {
+					tokens = append(tokens, pathToken{tokOp, op, i})
+					i += len(op)
+					continue loop
+				}
+			}
+			r, _ := utf8.DecodeRuneInString(path[i:])
+			c.fail(ErrPath("path has invalid character '"+string(r)+"'."), i, "")
+			return nil
 		}
-	default:
-		return newFilterChild(path)
 	}
+	return append(tokens, pathToken{tokEOF, "", len(path)})
+}
+
+// scanName returns the index of the first byte following the name that
+// starts at index i of the string s.
+func scanName(s string, i int) int {
+	for i < len(s) && (isNameStart(s[i]) || isDigit(s[i]) || s[i] == '-' || s[i] == '.') {
+		i++
+	}
+	return i
+}
+
+// isNameStart returns true if the byte may start an element or attribute
+// name. All non-ASCII bytes are accepted.
+func isNameStart(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || ch == '_' || ch >= 0x80
+}
+
+// isDigit returns true if the byte is a decimal digit.
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// newFilter creates a filter from the expression contained within a path
+// segment's [brackets]. Simple expressions are converted into specialized
+// filters, while all others are evaluated by an expression filter.
+func newFilter(e expr) filter {
+	switch e := e.(type) {
+	case *exprNumber:
+		if pos := int(e.val); float64(pos) == e.val {
+			switch {
+			case pos > 0:
+				return newFilterPos(pos - 1)
+			default:
+				return newFilterPos(pos)
+			}
+		}
+	case *exprPath:
+		if a, ok := e.attrOnly(); ok {
+			return &filterAttr{a.space, a.key}
+		}
+		if s, ok := e.childOnly(); ok {
+			return &filterChild{s.space, s.tag}
+		}
+	case *exprCall:
+		if fn, ok := fnTable[e.name]; ok {
+			return newFilterFunc(e.name, fn)
+		}
+	case *exprBinary:
+		lit, ok := e.right.(*exprLiteral)
+		if e.op != "=" || !ok {
+			break
+		}
+		switch l := e.left.(type) {
+		case *exprPath:
+			if a, ok := l.attrOnly(); ok {
+				return &filterAttrVal{a.space, a.key, lit.val}
+			}
+			if s, ok := l.childOnly(); ok {
+				return &filterChildText{s.space, s.tag, lit.val}
+			}
+		case *exprCall:
+			if fn, ok := fnTable[l.name]; ok {
+				return newFilterFuncVal(l.name, fn, lit.val)
+			}
+		}
+	}
+	return &filterExpr{e}
 }
 
 // selectSelf selects the current element into the candidate list.
@@ -369,6 +1639,10 @@ func (s *selectSelf) apply(e *Element, p *pather) {
 	p.candidates = append(p.candidates, e)
 }
 
+func (s *selectSelf) String() string {
+	return "."
+}
+
 // selectRoot selects the element's root node.
 type selectRoot struct{}
 
@@ -380,6 +1654,10 @@ func (s *selectRoot) apply(e *Element, p *pather) {
 	p.candidates = append(p.candidates, root)
 }
 
+func (s *selectRoot) String() string {
+	return ""
+}
+
 // selectParent selects the element's parent into the candidate list.
 type selectParent struct{}
 
@@ -389,6 +1667,10 @@ func (s *selectParent) apply(e *Element, p *pather) {
 	}
 }
 
+func (s *selectParent) String() string {
+	return ".."
+}
+
 // selectChildren selects the element's child elements into the
 // candidate list.
 type selectChildren struct{}
@@ -401,6 +1683,10 @@ func (s *selectChildren) apply(e *Element, p *pather) {
 	}
 }
 
+func (s *selectChildren) String() string {
+	return "*"
+}
+
 // selectDescendants selects all descendant child elements
 // of the element into the candidate list.
 type selectDescendants struct{}
@@ -418,25 +1704,190 @@ func (s *selectDescendants) apply(e *Element, p *pather) {
 	}
 }
 
+func (s *selectDescendants) String() string {
+	return ""
+}
+
+// A spaceTest matches the namespace of an element or attribute, either by
+// namespace prefix or, in paths compiled with a namespace map, by namespace
+// URI.
+type spaceTest struct {
+	space    string // namespace prefix; empty to match any namespace
+	uri      string // namespace URI, used only if resolved
+	resolved bool
+}
+
+func (t spaceTest) matchElement(e *Element) bool {
+	if t.resolved {
+		return e.NamespaceURI() == t.uri
+	}
+	return spaceMatch(t.space, e.Space)
+}
+
+func (t spaceTest) matchAttr(a *Attr) bool {
+	if t.resolved {
+		return a.NamespaceURI() == t.uri
+	}
+	return spaceMatch(t.space, a.Space)
+}
+
 // selectChildrenByTag selects into the candidate list all child
-// elements of the element having the specified tag.
+// elements of the element having the specified tag. A tag of "*"
+// selects all child elements with the specified namespace prefix.
 type selectChildrenByTag struct {
-	space, tag string
+	spaceTest
+	tag string
 }
 
 func newSelectChildrenByTag(path string) *selectChildrenByTag {
 	s, l := spaceDecompose(path)
-	return &selectChildrenByTag{s, l}
+	return &selectChildrenByTag{spaceTest{space: s}, l}
 }
 
 func (s *selectChildrenByTag) apply(e *Element, p *pather) {
 	for _, c := range e.Child {
-		if c, ok := c.(*Element); ok && spaceMatch(s.space, c.Space) && s.tag == c.Tag {
+		if c, ok := c.(*Element); ok && s.matchElement(c) && (s.tag == c.Tag || s.tag == "*") {
 			p.candidates = append(p.candidates, c)
 		}
 	}
 }
 
+func (s *selectChildrenByTag) String() string {
+	return spaceCompose(s.space, s.tag)
+}
+
+// selectAxis selects into the candidate list all elements along an
+// axis that have the specified tag. Elements are selected in the axis
+// order, which is reverse document order for reverse axes.
+type selectAxis struct {
+	axis string
+	walk axisWalker
+	spaceTest
+	tag string
+}
+
+// An axisWalker calls the visit function for each element along an axis
+// relative to the element e.
+type axisWalker func(e *Element, visit func(e *Element))
+
+var axisTable = map[string]axisWalker{
+	"self":               walkSelf,
+	"child":              walkChildren,
+	"parent":             walkParent,
+	"descendant":         walkDescendants,
+	"descendant-or-self": walkDescendantsOrSelf,
+	"ancestor":           walkAncestors,
+	"ancestor-or-self":   walkAncestorsOrSelf,
+	"following-sibling":  walkFollowingSiblings,
+	"preceding-sibling":  walkPrecedingSiblings,
+	"following":          walkFollowing,
+	"preceding":          walkPreceding,
+}
+
+func newSelectAxis(axis string, tag string) *selectAxis {
+	s, l := spaceDecompose(tag)
+	return &selectAxis{axis, axisTable[axis], spaceTest{space: s}, l}
+}
+
+func (s *selectAxis) apply(e *Element, p *pather) {
+	s.walk(e, func(c *Element) {
+		// The tag "*" matches any element but the document's element.
+		if s.matchElement(c) && (s.tag == c.Tag || (s.tag == "*" && c.Tag != "")) {
+			p.candidates = append(p.candidates, c)
+		}
+	})
+}
+
+func (s *selectAxis) String() string {
+	return s.axis + "::" + s.test()
+}
+
+// test returns the name test of the axis selector.
+func (s *selectAxis) test() string {
+	return spaceCompose(s.space, s.tag)
+}
+
+func walkSelf(e *Element, visit func(e *Element)) {
+	visit(e)
+}
+
+func walkChildren(e *Element, visit func(e *Element)) {
+	for _, c := range e.Child {
+		if c, ok := c.(*Element); ok {
+			visit(c)
+		}
+	}
+}
+
+func walkParent(e *Element, visit func(e *Element)) {
+	if e.parent != nil {
+		visit(e.parent)
+	}
+}
+
+func walkDescendants(e *Element, visit func(e *Element)) {
+	for _, c := range e.Child {
+		if c, ok := c.(*Element); ok {
+			visit(c)
+			walkDescendants(c, visit)
+		}
+	}
+}
+
+func walkDescendantsOrSelf(e *Element, visit func(e *Element)) {
+	visit(e)
+	walkDescendants(e, visit)
+}
+
+func walkAncestors(e *Element, visit func(e *Element)) {
+	for a := e.parent; a != nil; a = a.parent {
+		visit(a)
+	}
+}
+
+func walkAncestorsOrSelf(e *Element, visit func(e *Element)) {
+	visit(e)
+	walkAncestors(e, visit)
+}
+
+func walkFollowingSiblings(e *Element, visit func(e *Element)) {
+	for s := e.NextSibling(); s != nil; s = s.NextSibling() {
+		visit(s)
+	}
+}
+
+func walkPrecedingSiblings(e *Element, visit func(e *Element)) {
+	for s := e.PrevSibling(); s != nil; s = s.PrevSibling() {
+		visit(s)
+	}
+}
+
+func walkFollowing(e *Element, visit func(e *Element)) {
+	for a := e; a != nil; a = a.parent {
+		for s := a.NextSibling(); s != nil; s = s.NextSibling() {
+			walkDescendantsOrSelf(s, visit)
+		}
+	}
+}
+
+func walkPreceding(e *Element, visit func(e *Element)) {
+	// Visit each preceding sibling's subtree in reverse document order.
+	var reverse func(e *Element)
+	reverse = func(e *Element) {
+		for i := len(e.Child) - 1; i >= 0; i-- {
+			if c, ok := e.Child[i].(*Element); ok {
+				reverse(c)
+			}
+		}
+		visit(e)
+	}
+	for a := e; a != nil; a = a.parent {
+		for s := a.PrevSibling(); s != nil; s = s.PrevSibling() {
+			reverse(s)
+		}
+	}
+}
+
 // filterPos filters the candidate list, keeping only the
 // candidate at the specified index.
 type filterPos struct {
@@ -460,17 +1911,19 @@ func (f *filterPos) apply(p *pather) {
 	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
 }
 
+func (f *filterPos) String() string {
+	if f.index >= 0 {
+		return strconv.Itoa(f.index + 1)
+	}
+	return strconv.Itoa(f.index)
+}
+
 // filterAttr filters the candidate list for elements having
 // the specified attribute.
 type filterAttr struct {
 	space, key string
 }
 
-func newFilterAttr(str string) *filterAttr {
-	s, l := spaceDecompose(str)
-	return &filterAttr{s, l}
-}
-
 func (f *filterAttr) apply(p *pather) {
 	for _, c := range p.candidates {
 		for _, a := range c.Attr {
@@ -483,17 +1936,16 @@ func (f *filterAttr) apply(p *pather) {
 	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
 }
 
+func (f *filterAttr) String() string {
+	return "@" + spaceCompose(f.space, f.key)
+}
+
 // filterAttrVal filters the candidate list for elements having
 // the specified attribute with the specified value.
 type filterAttrVal struct {
 	space, key, val string
 }
 
-func newFilterAttrVal(str, value string) *filterAttrVal {
-	s, l := spaceDecompose(str)
-	return &filterAttrVal{s, l, value}
-}
-
 func (f *filterAttrVal) apply(p *pather) {
 	for _, c := range p.candidates {
 		for _, a := range c.Attr {
@@ -506,14 +1958,19 @@ func (f *filterAttrVal) apply(p *pather) {
 	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
 }
 
+func (f *filterAttrVal) String() string {
+	return "@" + spaceCompose(f.space, f.key) + " = " + quoteLiteral(f.val)
+}
+
 // filterFunc filters the candidate list for elements satisfying a custom
 // boolean function.
 type filterFunc struct {
-	fn func(e *Element) string
+	name string
+	fn   func(e *Element) string
 }
 
-func newFilterFunc(fn func(e *Element) string) *filterFunc {
-	return &filterFunc{fn}
+func newFilterFunc(name string, fn func(e *Element) string) *filterFunc {
+	return &filterFunc{name, fn}
 }
 
 func (f *filterFunc) apply(p *pather) {
@@ -525,15 +1982,20 @@ func (f *filterFunc) apply(p *pather) {
 	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
 }
 
+func (f *filterFunc) String() string {
+	return f.name + "()"
+}
+
 // filterFuncVal filters the candidate list for elements containing a value
 // matching the result of a custom function.
 type filterFuncVal struct {
-	fn  func(e *Element) string
-	val string
+	name string
+	fn   func(e *Element) string
+	val  string
 }
 
-func newFilterFuncVal(fn func(e *Element) string, value string) *filterFuncVal {
-	return &filterFuncVal{fn, value}
+func newFilterFuncVal(name string, fn func(e *Element) string, value string) *filterFuncVal {
+	return &filterFuncVal{name, fn, value}
 }
 
 func (f *filterFuncVal) apply(p *pather) {
@@ -545,17 +2007,16 @@ func (f *filterFuncVal) apply(p *pather) {
 	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
 }
 
+func (f *filterFuncVal) String() string {
+	return f.name + "() = " + quoteLiteral(f.val)
+}
+
 // filterChild filters the candidate list for elements having
 // a child element with the specified tag.
 type filterChild struct {
 	space, tag string
 }
 
-func newFilterChild(str string) *filterChild {
-	s, l := spaceDecompose(str)
-	return &filterChild{s, l}
-}
-
 func (f *filterChild) apply(p *pather) {
 	for _, c := range p.candidates {
 		for _, cc := range c.Child {
@@ -569,17 +2030,16 @@ func (f *filterChild) apply(p *pather) {
 	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
 }
 
+func (f *filterChild) String() string {
+	return spaceCompose(f.space, f.tag)
+}
+
 // filterChildText filters the candidate list for elements having
 // a child element with the specified tag and text.
 type filterChildText struct {
 	space, tag, text string
 }
 
-func newFilterChildText(str, text string) *filterChildText {
-	s, l := spaceDecompose(str)
-	return &filterChildText{s, l, text}
-}
-
 func (f *filterChildText) apply(p *pather) {
 	for _, c := range p.candidates {
 		for _, cc := range c.Child {
@@ -593,3 +2053,7 @@ func (f *filterChildText) apply(p *pather) {
 	}
 	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
 }
+
+func (f *filterChildText) String() string {
+	return spaceCompose(f.space, f.tag) + " = " + quoteLiteral(f.text)
+}
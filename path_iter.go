@@ -0,0 +1,28 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+
+package etree
+
+import "iter"
+
+// FindElementsSeq returns an iterator over the elements matched by the
+// XPath-like 'path' string. It panics if an invalid path string is
+// supplied. See FindElementsPathSeq.
+func (e *Element) FindElementsSeq(path string) iter.Seq[*Element] {
+	return e.FindElementsPathSeq(MustCompilePath(path))
+}
+
+// FindElementsPathSeq returns an iterator over the elements matched by the
+// 'path' object. The iterator yields the same elements in the same order as
+// FindElementsPath, but it finds them incrementally, so that breaking out of
+// a loop over the iterator ends the search without visiting the rest of the
+// element tree. The elements selected by a union of paths must all be found
+// before the first is yielded, since they are yielded in document order.
+func (e *Element) FindElementsPathSeq(path Path) iter.Seq[*Element] {
+	return func(yield func(*Element) bool) {
+		newPather().walk(e, path, yield)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+
+package etree
+
+import "testing"
+
+func TestFindElementsSeq(t *testing.T) {
+	doc := NewDocument()
+	err := doc.ReadFromString(testXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		path, err := CompilePath(test.path)
+		if err != nil {
+			continue
+		}
+		var elements []*Element
+		for e := range doc.FindElementsPathSeq(path) {
+			elements = append(elements, e)
+		}
+		expected := doc.FindElementsPath(path)
+		if len(elements) != len(expected) {
+			fail(t, test)
+			continue
+		}
+		for i := range elements {
+			if elements[i] != expected[i] {
+				fail(t, test)
+				break
+			}
+		}
+	}
+
+	var titles []string
+	for e := range doc.FindElementsSeq("//title") {
+		titles = append(titles, e.Text())
+		if len(titles) == 2 {
+			break
+		}
+	}
+	checkIntEq(t, len(titles), 2)
+	checkStrEq(t, titles[1], "Harry Potter")
+}
+
+func TestFindElementsSeqEarlyExit(t *testing.T) {
+	// Build a tree whose first match is near the top, followed by a large
+	// subtree that shouldn't be visited once the caller stops iterating.
+	doc := NewDocument()
+	root := doc.CreateElement("root")
+	root.CreateElement("match")
+	big := root.CreateElement("big")
+	for i := 0; i < 100; i++ {
+		big.CreateElement("match")
+	}
+
+	visited := 0
+	fn := func(e *Element, args []PathResult) any {
+		visited++
+		return true
+	}
+	path, err := CompilePathWithOptions("//match[visit()]", PathOptions{
+		Functions: map[string]PathFunc{"visit": fn},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range doc.FindElementsPathSeq(path) {
+		break
+	}
+	checkIntEq(t, visited, 1)
+
+	visited = 0
+	if doc.FindElementPath(path) == nil {
+		t.Fatal("etree: expected to find element")
+	}
+	checkIntEq(t, visited, 1)
+
+	visited = 0
+	checkIntEq(t, len(doc.FindElementsPath(path)), 101)
+	checkIntEq(t, visited, 101)
+}
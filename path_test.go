@@ -4,7 +4,11 @@
 
 package etree
 
-import "testing"
+import (
+	"errors"
+	"strings"
+	"testing"
+)
 
 var testXML = `
 <?xml version="1.0" encoding="UTF-8"?>
@@ -89,6 +93,25 @@ var tests = []test{
 	{"./bookstore/book[-4]/title", "Everyday Italian"},
 	{"./bookstore/book[-5]/title", nil},
 
+	// position function queries
+	{"./bookstore/book[last()]/title", "Learning XML"},
+	{"./bookstore/book[last()-1]/title", "XQuery Kick Start"},
+	{"./bookstore/book[position() < 3]/title", []string{"Everyday Italian", "Harry Potter"}},
+	{"./bookstore/book[position() >= last() - 1]/title", []string{"XQuery Kick Start", "Learning XML"}},
+	{"./bookstore/book[position() mod 2 = 0]/title", []string{"Harry Potter", "Learning XML"}},
+	{"./bookstore/book[position() = 1 or position() = last()]/title", []string{"Everyday Italian", "Learning XML"}},
+	{"./bookstore/book[3]/author[last()]", "Vaidyanathan Nagarajan"},
+	{"./bookstore/book[3]/author[2 * 2 - 1]", "Kurt Cagle"},
+	{"./bookstore/book[3]/author[last() div 5]", "James McGovern"},
+	{"./bookstore/book[@category='WEB'][last()]/title", "Learning XML"},
+	{"./bookstore/book[count(author) > 2]/title", "XQuery Kick Start"},
+	{"./bookstore/book[count(author) = 1][last()]/title", "Learning XML"},
+	{"./bookstore/book[count(editor) = 2]/title", "Harry Potter"},
+	{"./bookstore/book[count(*) = 5]/title", "Everyday Italian"},
+	{"./bookstore/book[count(@*) = 2]/title", "Learning XML"},
+	{"./bookstore/book[count(title/@*) + 1 = 3]/title", "Harry Potter"},
+	{"./bookstore/book[last()+1]/title", nil},
+
 	// text function queries
 	{"./bookstore/book[author='James McGovern']/title", "XQuery Kick Start"},
 	{"./bookstore/book[author='Per Bothner']/title", "XQuery Kick Start"},
@@ -126,6 +149,99 @@ var tests = []test{
 	{"//p:price[@p:tax]", []string{"29.99"}},
 	{"//p:price[@tax]", []string{"29.99"}},
 
+	// expression queries
+	{"//book[price > 30]/title", []string{"XQuery Kick Start", "Learning XML"}},
+	{"//book[price >= 30]/title", []string{"Everyday Italian", "XQuery Kick Start", "Learning XML"}},
+	{"//book[price < 30]/title", "Harry Potter"},
+	{"//book[price <= 30.00]/title", []string{"Everyday Italian", "Harry Potter"}},
+	{"//book[@category != 'WEB']/title", []string{"Everyday Italian", "Harry Potter"}},
+	{"//book[@category='WEB' and year=2003]/title", []string{"XQuery Kick Start", "Learning XML"}},
+	{"//book[@category='COOKING' or @category='CHILDREN']/title", []string{"Everyday Italian", "Harry Potter"}},
+	{"//book[not(@category='WEB')]/title", []string{"Everyday Italian", "Harry Potter"}},
+	{"//book[price > 30 and not(@category='WEB')]/title", nil},
+	{"//book[price > 35 and not(@category='COOKING')]/title", []string{"XQuery Kick Start", "Learning XML"}},
+	{"//book[(@category='WEB' or @category='CHILDREN') and year > 2004]/title", "Harry Potter"},
+	{"//book[ title/@lang = 'en' and title/@sku ]/title", "Harry Potter"},
+	{"//book[author != 'James McGovern']/title", []string{"Everyday Italian", "Harry Potter", "XQuery Kick Start", "Learning XML"}},
+	{"//book[not(author != 'Erik T. Ray')]/title", "Learning XML"},
+	{"//title[@sku > 100]", "Harry Potter"},
+	{"//book[p:price/@p:tax > 1]/title", "Harry Potter"},
+	{"//book[true()]/title", []string{"Everyday Italian", "Harry Potter", "XQuery Kick Start", "Learning XML"}},
+	{"//book[false()]/title", nil},
+	{"//book[1 = 1]/title", []string{"Everyday Italian", "Harry Potter", "XQuery Kick Start", "Learning XML"}},
+	{"//book[number(year) = 2005][2]/title", "Harry Potter"},
+	{"//book[boolean(editor)]/title", []string{"Everyday Italian", "Harry Potter", "XQuery Kick Start"}},
+	{"//book[.//@lang='en' and @category='WEB'][-1]/title", "Learning XML"},
+	{"/bookstore/p:*", nil},
+	{"/bookstore/book/p:*", []string{"30.00", "29.99", "39.95"}},
+
+	// string function queries
+	{"//book[contains(title, 'Potter')]/title", "Harry Potter"},
+	{"//book[contains(@path, 'xml')]/title", "Learning XML"},
+	{"//title[starts-with(text(), 'Every')]", "Everyday Italian"},
+	{"//title[starts-with(., 'X')]", "XQuery Kick Start"},
+	{"//title[ends-with(., 'XML')]", "Learning XML"},
+	{"//editor[normalize-space()='']", []string{"", "", "\n\t\t"}},
+	{"//editor[normalize-space(text())='Clarkson Potter']", "Clarkson Potter"},
+	{"//title[string-length() = 12]", []string{"Harry Potter", "Learning XML"}},
+	{"//title[string-length(@sku) = 3]", "Harry Potter"},
+	{"//title[substring(., 1, 5) = 'Harry']", "Harry Potter"},
+	{"//title[substring(., 10) = 'XML']", "Learning XML"},
+	{"//title[substring(., 1.5, 2.6) = 'ver']", "Everyday Italian"},
+	{"//title[substring-before(., ' ') = 'Learning']", "Learning XML"},
+	{"//title[substring-after(., 'Kick ') = 'Start']", "XQuery Kick Start"},
+	{"//title[translate(., 'abcdefghijklmnopqrstuvwxyz', 'ABCDEFGHIJKLMNOPQRSTUVWXYZ') = 'HARRY POTTER']", "Harry Potter"},
+	{"//title[translate(., 'aeiou ', '') = 'LrnngXML']", "Learning XML"},
+	{"//title[lower-case() = 'learning xml']", "Learning XML"},
+	{"//title[upper-case(@lang) = 'EN'][@sku]", "Harry Potter"},
+	{"//title[concat(@lang, '-', @sku) = 'en-150']", "Harry Potter"},
+	{"//book[string(@category) = 'CHILDREN']/title", "Harry Potter"},
+	{"//book[starts-with(author, 'J')]/title", []string{"Harry Potter", "XQuery Kick Start"}},
+	{"//title[contains(.)]", errorResult("etree: path has wrong number of arguments for function contains")},
+
+	// axis queries
+	{"//title[.='Harry Potter']/self::title", "Harry Potter"},
+	{"//title[.='Harry Potter']/self::author", nil},
+	{"/bookstore/child::book[1]/child::title", "Everyday Italian"},
+	{"//author[.='Kurt Cagle']/parent::book/title", "XQuery Kick Start"},
+	{"//author[.='Kurt Cagle']/parent::*/title", "XQuery Kick Start"},
+	{"/bookstore/book[2]/descendant::*[@p:tax]", "29.99"},
+	{"/bookstore/book[2]/descendant::editor", []string{"", ""}},
+	{"/bookstore/book[4]/descendant-or-self::*[@category]/title", "Learning XML"},
+	{"//p:price[@p:tax]/ancestor::book/title", "Harry Potter"},
+	{"//p:price[@p:tax]/ancestor::*[1]/title", "Harry Potter"},
+	{"//p:price[@p:tax]/ancestor::*[last()][self::bookstore]/book[1]/title", "Everyday Italian"},
+	{"//p:price[@p:tax]/ancestor-or-self::*[1]", "29.99"},
+	{"//author[.='Kurt Cagle']/following-sibling::author", []string{"James Linn", "Vaidyanathan Nagarajan"}},
+	{"//author[.='Kurt Cagle']/following-sibling::*[1]", "James Linn"},
+	{"//author[.='Kurt Cagle']/preceding-sibling::author", []string{"Per Bothner", "James McGovern"}},
+	{"//author[.='Kurt Cagle']/preceding-sibling::author[1]", "Per Bothner"},
+	{"//author[.='Kurt Cagle']/preceding-sibling::*[last()]", "XQuery Kick Start"},
+	{"//author[.='Kurt Cagle']/following::title", "Learning XML"},
+	{"//author[.='Kurt Cagle']/following::*[1]", "James Linn"},
+	{"//author[.='J K. Rowling']/preceding::title", []string{"Harry Potter", "Everyday Italian"}},
+	{"//author[.='J K. Rowling']/preceding::*[2]", "Clarkson Potter"},
+	{"//book[following-sibling::book[@category='WEB']]/title", []string{"Everyday Italian", "Harry Potter", "XQuery Kick Start"}},
+	{"//book[preceding-sibling::book[1][@category='WEB']]/title", "Learning XML"},
+	{"//book[count(preceding::author) = 1]/title", "Harry Potter"},
+	{"//book/sideways::title", errorResult("etree: path has unknown axis sideways")},
+	{"//book/child::[1]", errorResult("etree: path has invalid filter [brackets].")},
+
+	// union queries
+	{"//book[1]/title | //book[2]/title", []string{"Everyday Italian", "Harry Potter"}},
+	{"//book[2]/title | //book[1]/title", []string{"Everyday Italian", "Harry Potter"}},
+	{"//book[4]/title | //book[4]/author | //book[4]/*[1]", []string{"Learning XML", "Erik T. Ray"}},
+	{"//book[@category='WEB']/author[1] | //book[@category='WEB']/title", []string{"XQuery Kick Start", "James McGovern", "Learning XML", "Erik T. Ray"}},
+	{"//book[3] | //book[3]/year", []string{"\n\t\t", "2003"}},
+	{"//missing | //book[2]/title", "Harry Potter"},
+	{"//book[@bogus | editor]/year", []string{"2005", "2005", "2003"}},
+	{"//book[count(author | editor) = 2]/title", "Everyday Italian"},
+	{"//title[@sku | @bogus]", "Harry Potter"},
+	{"//title[count(@sku | ../@category) = 2]", "Harry Potter"},
+	{"//book[title | 'x']", errorResult("etree: path has union of non-path expressions.")},
+	{"//book |", errorResult("etree: path ends unexpectedly.")},
+	{"//book || //title", errorResult("etree: path has unexpected '|'.")},
+
 	// parent queries
 	{"./bookstore/book[@category='COOKING']/title/../../book[4]/title", "Learning XML"},
 
@@ -149,6 +265,13 @@ var tests = []test{
 	{`./bookstore/book[@category="WEB']`, errorResult("etree: path has mismatched filter quotes.")},
 	{"./bookstore/book[author]a", errorResult("etree: path has invalid filter [brackets].")},
 	{"/][", errorResult("etree: path has invalid filter [brackets].")},
+	{"//book[@category=]", errorResult("etree: path has invalid filter [brackets].")},
+	{"//book[@category='WEB' 'COOKING']", errorResult("etree: path has unexpected ''COOKING''.")},
+	{"//book[bogus()]", errorResult("etree: path has unknown function bogus")},
+	{"//book[not()]", errorResult("etree: path has wrong number of arguments for function not")},
+	{"//book[(@category='WEB']", errorResult("etree: path has invalid filter [brackets].")},
+	{"//book[@category='WEB' and]", errorResult("etree: path has invalid filter [brackets].")},
+	{"//book#", errorResult("etree: path has invalid character '#'.")},
 }
 
 func TestPath(t *testing.T) {
@@ -224,3 +347,409 @@ func TestAbsolutePath(t *testing.T) {
 		}
 	}
 }
+
+func TestPathEvaluate(t *testing.T) {
+	doc := NewDocument()
+	err := doc.ReadFromString(testXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := MustCompilePath("//book/@category").Evaluate(&doc.Element)
+	checkIntEq(t, int(r.Type), int(NodeSetResult))
+	checkIntEq(t, len(r.Attrs), 4)
+	for i, v := range []string{"COOKING", "CHILDREN", "WEB", "WEB"} {
+		checkStrEq(t, r.Attrs[i].Value, v)
+	}
+
+	r = MustCompilePath("//title[@sku]/@* | //book[1]/@category").Evaluate(&doc.Element)
+	checkIntEq(t, len(r.Attrs), 3)
+	checkIntEq(t, len(r.Elements), 0)
+
+	r = MustCompilePath("/bookstore/book[1]/title/text()").Evaluate(&doc.Element)
+	checkIntEq(t, len(r.CharData), 1)
+	checkStrEq(t, r.CharData[0].Data, "Everyday Italian")
+
+	r = MustCompilePath("/bookstore/comment()").Evaluate(doc.Root())
+	checkIntEq(t, len(r.Comments), 1)
+	checkStrEq(t, r.Comments[0].Data, " Final book ")
+
+	r = MustCompilePath("//book/title").Evaluate(&doc.Element)
+	checkIntEq(t, int(r.Type), int(NodeSetResult))
+	checkIntEq(t, len(r.Elements), 4)
+
+	r = MustCompilePath("count(//book)").Evaluate(&doc.Element)
+	checkIntEq(t, int(r.Type), int(NumberResult))
+	checkIntEq(t, int(r.Number), 4)
+
+	r = MustCompilePath("count(//book[@category='WEB']/author) + 1").Evaluate(&doc.Element)
+	checkIntEq(t, int(r.Number), 7)
+
+	r = MustCompilePath("string(//book[2]/title)").Evaluate(&doc.Element)
+	checkIntEq(t, int(r.Type), int(StringResult))
+	checkStrEq(t, r.String, "Harry Potter")
+
+	r = MustCompilePath("//book[1]/year = 2005").Evaluate(&doc.Element)
+	checkIntEq(t, int(r.Type), int(BooleanResult))
+	checkBoolEq(t, r.Boolean, true)
+
+	r = MustCompilePath("author = 'Per Bothner'").Evaluate(doc.FindElement("//book[3]"))
+	checkBoolEq(t, r.Boolean, true)
+
+	checkIntEq(t, len(doc.FindElements("//book/@category")), 0)
+	checkIntEq(t, len(doc.FindElements("count(//book)")), 0)
+
+	_, err = CompilePath("count(//book")
+	if err == nil || err.Error() != "etree: path ends unexpectedly." {
+		t.Errorf("etree: unexpected error for unterminated function call: %v", err)
+	}
+}
+
+func TestCompilePathNS(t *testing.T) {
+	s := `<root xmlns:s="urn:soap" xmlns:x="urn:other">
+	<s:Envelope>
+		<s:Body s:id="1">one</s:Body>
+		<x:Body x:id="2">two</x:Body>
+		<Body xmlns="urn:soap">three</Body>
+	</s:Envelope>
+</root>`
+
+	doc := NewDocument()
+	err := doc.ReadFromString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns := map[string]string{"soap": "urn:soap", "o": "urn:other"}
+	cases := []struct {
+		path   string
+		result []string
+	}{
+		{"//soap:Body", []string{"one", "three"}},
+		{"//o:Body", []string{"two"}},
+		{"//Body", []string{"one", "two", "three"}},
+		{"//soap:Envelope/soap:*", []string{"one", "three"}},
+		{"//soap:Envelope/soap:Body[1]", []string{"one"}},
+		{"//soap:Envelope/child::soap:Body", []string{"one", "three"}},
+		{"//*[@soap:id]", []string{"one"}},
+		{"//*[@o:id='2']", []string{"two"}},
+		{"//*[soap:Body='three']/o:Body", []string{"two"}},
+	}
+	for _, c := range cases {
+		path, err := CompilePathNS(c.path, ns)
+		if err != nil {
+			t.Errorf("etree: failed to compile '%s': %v", c.path, err)
+			continue
+		}
+		elements := doc.FindElementsPath(path)
+		if len(elements) != len(c.result) {
+			t.Errorf("etree: path '%s' selected %d elements, expected %d", c.path, len(elements), len(c.result))
+			continue
+		}
+		for i, e := range elements {
+			checkStrEq(t, e.Text(), c.result[i])
+		}
+	}
+
+	elements := doc.FindElementsPath(MustCompilePathNS("//Body", map[string]string{"": "urn:soap"}))
+	checkIntEq(t, len(elements), 2)
+
+	_, err = CompilePathNS("//soap:Body", map[string]string{})
+	if err == nil || err.Error() != "etree: path has undeclared namespace prefix soap" {
+		t.Errorf("etree: expected undeclared namespace prefix error, got %v", err)
+	}
+}
+
+func TestPathVariables(t *testing.T) {
+	doc := NewDocument()
+	err := doc.ReadFromString(testXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := MustCompilePath("//book[@category=$category]/title")
+	checkIntEq(t, len(doc.FindElementsPath(path)), 0)
+
+	titles := doc.FindElementsPath(path.WithVariables(map[string]any{"category": "WEB"}))
+	checkIntEq(t, len(titles), 2)
+	checkStrEq(t, titles[0].Text(), "XQuery Kick Start")
+
+	title := doc.FindElementPath(path.WithVariables(map[string]any{"category": "CHILDREN"}))
+	checkStrEq(t, title.Text(), "Harry Potter")
+
+	// Values that would require quoting in a path string
+	path = MustCompilePath("//title[.=$title]")
+	doc.FindElement("//book[1]/title").SetText(`Don't "quote" me`)
+	title = doc.FindElementPath(path.WithVariables(map[string]any{"title": `Don't "quote" me`}))
+	if title == nil {
+		t.Fatalf("etree: failed to find element using variable containing quotes")
+	}
+
+	path = MustCompilePath("/bookstore/book[$n]/title")
+	title = doc.FindElementPath(path.WithVariables(map[string]any{"n": 2}))
+	checkStrEq(t, title.Text(), "Harry Potter")
+
+	path = MustCompilePath("//book[title = $titles]/year")
+	webTitles := doc.FindElements("//book[@category='WEB']/title")
+	years := doc.FindElementsPath(path.WithVariables(map[string]any{"titles": webTitles}))
+	checkIntEq(t, len(years), 2)
+
+	r := MustCompilePath("count(//book[year > $year])").
+		WithVariables(map[string]any{"year": 2004.5}).
+		Evaluate(&doc.Element)
+	checkIntEq(t, int(r.Number), 2)
+
+	_, err = CompilePath("//book[@category=$]")
+	if err == nil {
+		t.Errorf("etree: expected error for missing variable name")
+	}
+}
+
+func TestPathFunctions(t *testing.T) {
+	doc := NewDocument()
+	err := doc.ReadFromString(testXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := PathOptions{
+		Functions: map[string]PathFunc{
+			"is-web": func(e *Element, args []PathResult) any {
+				return e.SelectAttrValue("category", "") == "WEB"
+			},
+			"has-prefix": func(e *Element, args []PathResult) any {
+				return strings.HasPrefix(args[0].StringValue(), args[1].StringValue())
+			},
+			"double": func(e *Element, args []PathResult) any {
+				return args[0].NumberValue() * 2
+			},
+			"first-author": func(e *Element, args []PathResult) any {
+				return e.SelectElement("author")
+			},
+		},
+	}
+
+	cases := []struct {
+		path   string
+		result []string
+	}{
+		{"//book[is-web()]/title", []string{"XQuery Kick Start", "Learning XML"}},
+		{"//book[not(is-web())]/title", []string{"Everyday Italian", "Harry Potter"}},
+		{"//title[has-prefix(., $p)]", []string{"Harry Potter"}},
+		{"//book[double(year) = 4006]/title", []string{"XQuery Kick Start", "Learning XML"}},
+		{"//book[first-author() = 'Per Bothner' or first-author() = 'Erik T. Ray']/title", []string{"Learning XML"}},
+	}
+	for _, c := range cases {
+		path, err := CompilePathWithOptions(c.path, opts)
+		if err != nil {
+			t.Errorf("etree: failed to compile '%s': %v", c.path, err)
+			continue
+		}
+		path = path.WithVariables(map[string]any{"p": "Har"})
+		elements := doc.FindElementsPath(path)
+		if len(elements) != len(c.result) {
+			t.Errorf("etree: path '%s' selected %d elements, expected %d", c.path, len(elements), len(c.result))
+			continue
+		}
+		for i, e := range elements {
+			checkStrEq(t, e.Text(), c.result[i])
+		}
+	}
+
+	_, err = CompilePath("//book[is-web()]")
+	if err == nil || err.Error() != "etree: path has unknown function is-web" {
+		t.Errorf("etree: expected unknown function error, got %v", err)
+	}
+}
+
+func TestPathMatches(t *testing.T) {
+	doc := NewDocument()
+	err := doc.ReadFromString(testXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := append([]*Element{&doc.Element}, doc.FindElements("//*")...)
+
+	for _, test := range tests {
+		path, err := CompilePath(test.path)
+		if err != nil {
+			continue
+		}
+		selected := make(map[*Element]bool)
+		for _, e := range doc.FindElementsPath(path) {
+			selected[e] = true
+		}
+		for _, e := range all {
+			if path.Matches(e) != selected[e] {
+				t.Errorf("etree: Matches failed for path '%s' and element <%s>", test.path, e.FullTag())
+				break
+			}
+		}
+	}
+
+	item := doc.FindElement("//book[3]/author[2]")
+	checkBoolEq(t, MustCompilePath("//author").Matches(item), true)
+	checkBoolEq(t, MustCompilePath("//book[@category='WEB']/author[2]").Matches(item), true)
+	checkBoolEq(t, MustCompilePath("//book[@category='WEB']/author[1]").Matches(item), false)
+	checkBoolEq(t, MustCompilePath("/bookstore/book/author[last()-3]").Matches(item), true)
+	checkBoolEq(t, MustCompilePath("//author/preceding-sibling::author").Matches(item), true)
+	checkBoolEq(t, MustCompilePath("//title | //author").Matches(item), true)
+	checkBoolEq(t, MustCompilePath("//title").Matches(item), false)
+}
+
+func TestPathString(t *testing.T) {
+	cases := []struct {
+		path, normalized string
+	}{
+		{"//book", "//book"},
+		{"/bookstore/book[1]/title", "/bookstore/book[1]/title"},
+		{"./bookstore/book[@category='WEB']", "./bookstore/book[@category = 'WEB']"},
+		{".//book[ title = \"Don't\" ]", ".//book[title = \"Don't\"]"},
+		{"//book[p:price>30 and not(@category='WEB')]", "//book[p:price > 30 and not(@category = 'WEB')]"},
+		{"//book[(@a or @b) and @c]", "//book[(@a or @b) and @c]"},
+		{"//book[@a or (@b and @c)]", "//book[@a or @b and @c]"},
+		{"//book[1-(2-3)]", "//book[1 - (2 - 3)]"},
+		{"//book[(1-2)-3]", "//book[1 - 2 - 3]"},
+		{"//book[-(1+2)]", "//book[-(1 + 2)]"},
+		{"//book[-1]", "//book[-1]"},
+		{"//book[0]", "//book[1]"},
+		{"//book[text()='x'][text()]", "//book[text() = 'x'][text()]"},
+		{"//book[substring(title,1,2)='Ha']", "//book[substring(title, 1, 2) = 'Ha']"},
+		{"/bookstore//p:*/ancestor::book/child::title/@lang", "/bookstore//p:*/ancestor::book/child::title/@lang"},
+		{"//title/text()", "//title/text()"},
+		{"//a|//b", "//a | //b"},
+		{"//book[title|author]", "//book[title | author]"},
+		{"//book[@category=$c]/..", "//book[@category = $c]/.."},
+		{"count(//book)", "count(//book)"},
+		{"//book[/]", "//book[/]"},
+		{"/", "/"},
+		{"", ""},
+		{"a//", "a//*"},
+	}
+	for _, c := range cases {
+		path, err := CompilePath(c.path)
+		if err != nil {
+			t.Errorf("etree: failed to compile '%s': %v", c.path, err)
+			continue
+		}
+		checkStrEq(t, path.String(), c.normalized)
+	}
+
+	// The normalized form of each test path compiles to an equivalent path.
+	doc := NewDocument()
+	err := doc.ReadFromString(testXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		path, err := CompilePath(test.path)
+		if err != nil {
+			continue
+		}
+		normalized, err := CompilePath(path.String())
+		if err != nil {
+			t.Errorf("etree: failed to compile normalized form '%s' of '%s': %v", path.String(), test.path, err)
+			continue
+		}
+		checkStrEq(t, normalized.String(), path.String())
+		a, b := doc.FindElementsPath(path), doc.FindElementsPath(normalized)
+		if len(a) != len(b) {
+			t.Errorf("etree: normalized form '%s' of '%s' selects different elements", path.String(), test.path)
+		}
+	}
+}
+
+func TestPathSteps(t *testing.T) {
+	path := MustCompilePath("/bookstore//book[@category='WEB'][2]/following-sibling::p:*/.. | ./title")
+	steps := path.Steps()
+	checkIntEq(t, len(steps), 2)
+
+	expected := []PathStep{
+		{Axis: "root"},
+		{Axis: "child", Test: "bookstore"},
+		{Axis: "descendant-or-self"},
+		{Axis: "child", Test: "book", Filters: []string{"@category = 'WEB'", "2"}},
+		{Axis: "following-sibling", Test: "p:*"},
+		{Axis: "parent"},
+	}
+	checkIntEq(t, len(steps[0]), len(expected))
+	for i := 0; i < len(steps[0]) && i < len(expected); i++ {
+		s, e := steps[0][i], expected[i]
+		checkStrEq(t, s.Axis, e.Axis)
+		checkStrEq(t, s.Test, e.Test)
+		checkStrEq(t, strings.Join(s.Filters, ","), strings.Join(e.Filters, ","))
+	}
+
+	checkIntEq(t, len(steps[1]), 2)
+	checkStrEq(t, steps[1][0].Axis, "self")
+	checkStrEq(t, steps[1][1].Test, "title")
+
+	if MustCompilePath("count(//book)").Steps() != nil {
+		t.Errorf("etree: expected no steps for expression path")
+	}
+}
+
+func TestPathError(t *testing.T) {
+	cases := []struct {
+		path     string
+		err      string
+		offset   int
+		segment  string
+		expected string
+	}{
+		{"./bookstore/book[]", "path contains an empty filter expression.", 16, "book[]", "an expression"},
+		{"./bookstore/book[@category='WEB'", "path has invalid filter [brackets].", 32, "book[@category='WEB'", "']'"},
+		{"./bookstore/book[@category='WEB]/title", "path has mismatched filter quotes.", 27, "book[@category='WEB]/title", "a closing quote"},
+		{"/bookstore/book[@a 'x']/title", "path has unexpected ''x''.", 19, "book[@a 'x']", "']'"},
+		{"//book[bogus(1)]", "path has unknown function bogus", 7, "book[bogus(1)]", ""},
+		{"//book[contains(title, 'x'", "path ends unexpectedly.", 26, "book[contains(title, 'x'", "')'"},
+		{"/bookstore/sideways::book", "path has unknown axis sideways", 11, "sideways::book", ""},
+		{"/bookstore/child::[1]", "path has invalid filter [brackets].", 18, "child::[1]", "an element name or '*'"},
+		{"//book/@", "path ends unexpectedly.", 8, "@", "an attribute name or '*'"},
+		{"//book |", "path ends unexpectedly.", 8, "", "a path"},
+		{"//book[title | 'x']", "path has union of non-path expressions.", 15, "book[title | 'x']", "a path"},
+		{"//book#", "path has invalid character '#'.", 6, "book#", ""},
+		{"//book[$]", "path has invalid filter [brackets].", 8, "book[$]", "a variable name"},
+	}
+	for _, c := range cases {
+		_, err := CompilePathWithOptions(c.path, PathOptions{})
+		var pe *PathError
+		if !errors.As(err, &pe) {
+			t.Errorf("etree: expected PathError for '%s', got %v", c.path, err)
+			continue
+		}
+		checkStrEq(t, err.Error(), "etree: "+c.err)
+		checkStrEq(t, pe.Path, c.path)
+		checkIntEq(t, pe.Offset, c.offset)
+		checkStrEq(t, pe.Segment, c.segment)
+		checkStrEq(t, pe.Expected, c.expected)
+
+		var ep ErrPath
+		if !errors.As(err, &ep) || string(ep) != c.err {
+			t.Errorf("etree: expected PathError for '%s' to wrap ErrPath", c.path)
+		}
+
+		// CompilePath returns the ErrPath itself.
+		_, err = CompilePath(c.path)
+		if ep, ok := err.(ErrPath); !ok || string(ep) != c.err {
+			t.Errorf("etree: expected ErrPath for '%s', got %v", c.path, err)
+		}
+	}
+
+	func() {
+		defer func() {
+			if _, ok := recover().(ErrPath); !ok {
+				t.Error("etree: expected MustCompilePath to panic with ErrPath")
+			}
+		}()
+		MustCompilePath("//book[]")
+	}()
+
+	_, err := CompilePathWithOptions("//a/x:b", PathOptions{Namespaces: map[string]string{}})
+	var pe *PathError
+	if !errors.As(err, &pe) {
+		t.Fatalf("etree: expected PathError, got %v", err)
+	}
+	checkIntEq(t, pe.Offset, 4)
+	checkStrEq(t, pe.Segment, "x:b")
+}
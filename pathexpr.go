@@ -0,0 +1,838 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package etree
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// An expr is a node in the syntax tree of a filter expression. Its String
+// method returns the expression in normalized form.
+type expr interface {
+	eval(ctx *evalContext) value
+	String() string
+}
+
+// precedence returns the binding strength of an expression's outermost
+// operator. Operands of lower precedence require parentheses.
+func precedence(x expr) int {
+	switch x := x.(type) {
+	case *exprBinary:
+		switch x.op {
+		case "or":
+			return 1
+		case "and":
+			return 2
+		case "=", "!=":
+			return 3
+		case "<", "<=", ">", ">=":
+			return 4
+		case "+", "-":
+			return 5
+		default:
+			return 6
+		}
+	case *exprNegate:
+		return 7
+	default:
+		return 8
+	}
+}
+
+// operandString returns the string form of an operand of an operator with
+// the precedence 'prec', enclosing it in parentheses if necessary.
+func operandString(x expr, prec int) string {
+	if precedence(x) < prec {
+		return "(" + x.String() + ")"
+	}
+	return x.String()
+}
+
+// quoteLiteral returns the string enclosed in single quotes, or in double
+// quotes if it contains a single quote.
+func quoteLiteral(s string) string {
+	if strings.ContainsRune(s, '\'') {
+		return `"` + s + `"`
+	}
+	return "'" + s + "'"
+}
+
+// An evalContext holds the state used to evaluate a filter expression
+// against a single candidate element.
+type evalContext struct {
+	e    *Element       // the candidate element
+	pos  int            // 1-based position of the candidate in the candidate list
+	size int            // number of elements in the candidate list
+	vars map[string]any // values bound to variables
+}
+
+// A value is the result of evaluating a filter expression. Its dynamic type
+// is always one of nodeSet, string, float64 or bool.
+type value any
+
+// A nodeSet is an ordered collection of the elements, attributes, text
+// nodes or comments selected by a location path within an expression. At
+// most one of its slices is non-empty, unless the node set is a union of
+// paths selecting different kinds of nodes.
+type nodeSet struct {
+	elements []*Element
+	attrs    []*Attr
+	charData []*CharData
+	comments []*Comment
+}
+
+// any returns true if the function 'f' returns true for the string value of
+// any node in the node set. The string value of an element is its text, the
+// string value of an attribute is its value, and the string value of a text
+// node or comment is its data.
+func (n nodeSet) any(f func(s string) bool) bool {
+	for _, e := range n.elements {
+		if f(e.Text()) {
+			return true
+		}
+	}
+	for _, a := range n.attrs {
+		if f(a.Value) {
+			return true
+		}
+	}
+	for _, c := range n.charData {
+		if f(c.Data) {
+			return true
+		}
+	}
+	for _, c := range n.comments {
+		if f(c.Data) {
+			return true
+		}
+	}
+	return false
+}
+
+// len returns the number of nodes in the node set.
+func (n nodeSet) len() int {
+	return len(n.elements) + len(n.attrs) + len(n.charData) + len(n.comments)
+}
+
+// empty returns true if the node set contains no nodes.
+func (n nodeSet) empty() bool {
+	return n.len() == 0
+}
+
+// String returns the string value of the first node in the node set, or the
+// empty string if the node set is empty.
+func (n nodeSet) String() string {
+	switch {
+	case len(n.elements) > 0:
+		return n.elements[0].Text()
+	case len(n.attrs) > 0:
+		return n.attrs[0].Value
+	case len(n.charData) > 0:
+		return n.charData[0].Data
+	case len(n.comments) > 0:
+		return n.comments[0].Data
+	default:
+		return ""
+	}
+}
+
+// toValue converts a value provided by the caller, such as the value bound
+// to a variable, into a value. Values of unsupported types are converted to
+// strings.
+func toValue(v any) value {
+	switch v := v.(type) {
+	case string, float64, bool, nodeSet:
+		return v
+	case int:
+		return float64(v)
+	case *Element:
+		return nodeSet{elements: []*Element{v}}
+	case []*Element:
+		return nodeSet{elements: v}
+	case []*Attr:
+		return nodeSet{attrs: v}
+	case PathResult:
+		return v.value()
+	case nil:
+		return nodeSet{}
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// newPathResult converts a value into a path result.
+func newPathResult(v value) PathResult {
+	switch v := v.(type) {
+	case nodeSet:
+		return PathResult{
+			Type:     NodeSetResult,
+			Elements: v.elements,
+			Attrs:    v.attrs,
+			CharData: v.charData,
+			Comments: v.comments,
+		}
+	case string:
+		return PathResult{Type: StringResult, String: v}
+	case float64:
+		return PathResult{Type: NumberResult, Number: v}
+	default:
+		return PathResult{Type: BooleanResult, Boolean: toBoolean(v)}
+	}
+}
+
+// value converts the path result into a value.
+func (r PathResult) value() value {
+	switch r.Type {
+	case StringResult:
+		return r.String
+	case NumberResult:
+		return r.Number
+	case BooleanResult:
+		return r.Boolean
+	default:
+		return nodeSet{r.Elements, r.Attrs, r.CharData, r.Comments}
+	}
+}
+
+// StringValue returns the path result converted to a string. The string
+// value of a node set is the string value of its first node.
+func (r PathResult) StringValue() string {
+	return toString(r.value())
+}
+
+// NumberValue returns the path result converted to a number. The result is
+// NaN if it can't be converted.
+func (r PathResult) NumberValue() float64 {
+	return toNumber(r.value())
+}
+
+// BooleanValue returns the path result converted to a boolean. A node set
+// converts to true if it isn't empty.
+func (r PathResult) BooleanValue() bool {
+	return toBoolean(r.value())
+}
+
+// toBoolean converts a value to a boolean.
+func toBoolean(v value) bool {
+	switch v := v.(type) {
+	case nodeSet:
+		return !v.empty()
+	case string:
+		return v != ""
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case bool:
+		return v
+	default:
+		return false
+	}
+}
+
+// toNumber converts a value to a number. Strings that don't contain a
+// decimal number convert to NaN.
+func toNumber(v value) float64 {
+	switch v := v.(type) {
+	case nodeSet:
+		return stringToNumber(v.String())
+	case string:
+		return stringToNumber(v)
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	default:
+		return math.NaN()
+	}
+}
+
+// toString converts a value to a string.
+func toString(v value) string {
+	switch v := v.(type) {
+	case nodeSet:
+		return v.String()
+	case string:
+		return v
+	case float64:
+		return numberToString(v)
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	default:
+		return ""
+	}
+}
+
+// stringToNumber parses a string containing an optionally signed decimal
+// number surrounded by optional whitespace. It returns NaN if the string
+// contains anything else.
+func stringToNumber(s string) float64 {
+	s = strings.TrimSpace(s)
+	digits := strings.TrimPrefix(s, "-")
+	if digits == "" || digits == "." {
+		return math.NaN()
+	}
+	dot := false
+	for i := 0; i < len(digits); i++ {
+		switch {
+		case digits[i] == '.' && !dot:
+			dot = true
+		case !isDigit(digits[i]):
+			return math.NaN()
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return f
+}
+
+// numberToString formats a number the way XPath does, without an exponent
+// and without a fractional part when the number is an integer.
+func numberToString(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case f == 0:
+		return "0"
+	default:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+}
+
+// compare applies the comparison operator 'op' to two values, following the
+// XPath rules for comparing node sets: a comparison involving a node set is
+// true if it is true for the string value of any node in the set.
+func compare(op string, a, b value) bool {
+	an, aIsNodes := a.(nodeSet)
+	bn, bIsNodes := b.(nodeSet)
+	_, aIsBool := a.(bool)
+	_, bIsBool := b.(bool)
+	switch {
+	case aIsNodes && bIsNodes:
+		return an.any(func(s string) bool {
+			return bn.any(func(t string) bool { return compareAtoms(op, s, t) })
+		})
+	case (aIsNodes && bIsBool) || (bIsNodes && aIsBool):
+		return compareAtoms(op, toBoolean(a), toBoolean(b))
+	case aIsNodes:
+		return an.any(func(s string) bool { return compareAtoms(op, s, b) })
+	case bIsNodes:
+		return bn.any(func(t string) bool { return compareAtoms(op, a, t) })
+	default:
+		return compareAtoms(op, a, b)
+	}
+}
+
+// compareAtoms applies the comparison operator 'op' to two values, neither
+// of which is a node set.
+func compareAtoms(op string, a, b value) bool {
+	if op == "=" || op == "!=" {
+		var eq bool
+		_, aIsBool := a.(bool)
+		_, bIsBool := b.(bool)
+		_, aIsNum := a.(float64)
+		_, bIsNum := b.(float64)
+		switch {
+		case aIsBool || bIsBool:
+			eq = toBoolean(a) == toBoolean(b)
+		case aIsNum || bIsNum:
+			eq = toNumber(a) == toNumber(b)
+		default:
+			eq = toString(a) == toString(b)
+		}
+		return eq == (op == "=")
+	}
+
+	x, y := toNumber(a), toNumber(b)
+	switch op {
+	case "<":
+		return x < y
+	case "<=":
+		return x <= y
+	case ">":
+		return x > y
+	case ">=":
+		return x >= y
+	default:
+		return false
+	}
+}
+
+// exprLiteral is a quoted string literal.
+type exprLiteral struct {
+	val string
+}
+
+func (x *exprLiteral) eval(ctx *evalContext) value {
+	return x.val
+}
+
+func (x *exprLiteral) String() string {
+	return quoteLiteral(x.val)
+}
+
+// exprNumber is a numeric literal.
+type exprNumber struct {
+	val float64
+}
+
+func (x *exprNumber) eval(ctx *evalContext) value {
+	return x.val
+}
+
+func (x *exprNumber) String() string {
+	return numberToString(x.val)
+}
+
+// exprNegate negates the numeric value of an expression.
+type exprNegate struct {
+	x expr
+}
+
+func (x *exprNegate) eval(ctx *evalContext) value {
+	return -toNumber(x.x.eval(ctx))
+}
+
+func (x *exprNegate) String() string {
+	return "-" + operandString(x.x, precedence(x))
+}
+
+// exprBinary applies a boolean, comparison or arithmetic operator to two
+// expressions.
+type exprBinary struct {
+	op          string
+	left, right expr
+}
+
+func (x *exprBinary) eval(ctx *evalContext) value {
+	switch x.op {
+	case "or":
+		return toBoolean(x.left.eval(ctx)) || toBoolean(x.right.eval(ctx))
+	case "and":
+		return toBoolean(x.left.eval(ctx)) && toBoolean(x.right.eval(ctx))
+	case "+":
+		return toNumber(x.left.eval(ctx)) + toNumber(x.right.eval(ctx))
+	case "-":
+		return toNumber(x.left.eval(ctx)) - toNumber(x.right.eval(ctx))
+	case "*":
+		return toNumber(x.left.eval(ctx)) * toNumber(x.right.eval(ctx))
+	case "div":
+		return toNumber(x.left.eval(ctx)) / toNumber(x.right.eval(ctx))
+	case "mod":
+		return math.Mod(toNumber(x.left.eval(ctx)), toNumber(x.right.eval(ctx)))
+	default:
+		return compare(x.op, x.left.eval(ctx), x.right.eval(ctx))
+	}
+}
+
+func (x *exprBinary) String() string {
+	// Binary operators are left-associative, so a right operand of equal
+	// precedence requires parentheses.
+	prec := precedence(x)
+	return operandString(x.left, prec) + " " + x.op + " " + operandString(x.right, prec+1)
+}
+
+// exprPath selects a node set using a location path evaluated from the
+// candidate element. If the path ends with an attribute selector or a node
+// test, the node set contains attributes, text nodes or comments; otherwise
+// it contains elements.
+type exprPath struct {
+	segments []segment // empty if the path selects only attributes
+	attr     *attrTest // trailing attribute selector, if any
+	node     string    // trailing node test ("text" or "comment"), if any
+}
+
+// An attrTest matches attributes by namespace and key. A key of "*" matches
+// all attributes.
+type attrTest struct {
+	spaceTest
+	key string
+}
+
+func (t *attrTest) matches(a *Attr) bool {
+	return t.matchAttr(a) && (t.key == "*" || t.key == a.Key)
+}
+
+func (x *exprPath) eval(ctx *evalContext) value {
+	var elements []*Element
+	if len(x.segments) == 0 {
+		elements = []*Element{ctx.e}
+	} else {
+		elements = newPather().traverse(ctx.e, Path{paths: [][]segment{x.segments}, vars: ctx.vars})
+	}
+
+	var n nodeSet
+	switch {
+	case x.attr != nil:
+		for _, e := range elements {
+			for i := range e.Attr {
+				if x.attr.matches(&e.Attr[i]) {
+					n.attrs = append(n.attrs, &e.Attr[i])
+				}
+			}
+		}
+	case x.node == "text":
+		for _, e := range elements {
+			for _, c := range e.Child {
+				if c, ok := c.(*CharData); ok {
+					n.charData = append(n.charData, c)
+				}
+			}
+		}
+	case x.node == "comment":
+		for _, e := range elements {
+			for _, c := range e.Child {
+				if c, ok := c.(*Comment); ok {
+					n.comments = append(n.comments, c)
+				}
+			}
+		}
+	default:
+		n.elements = elements
+	}
+	return n
+}
+
+func (x *exprPath) String() string {
+	var last string
+	switch {
+	case x.attr != nil:
+		last = "@" + spaceCompose(x.attr.space, x.attr.key)
+	case x.node != "":
+		last = x.node + "()"
+	}
+	return segmentsString(x.segments, last)
+}
+
+// attrOnly returns the path's attribute selector if the path consists of
+// nothing but a single non-wildcard attribute selector (@attrib) matched by
+// namespace prefix.
+func (x *exprPath) attrOnly() (*attrTest, bool) {
+	if len(x.segments) == 0 && x.attr != nil && x.attr.key != "*" && x.node == "" && !x.attr.resolved {
+		return x.attr, true
+	}
+	return nil, false
+}
+
+// childOnly returns the path's selector if the path consists of nothing but
+// a single unfiltered child element selector (tag) matched by namespace
+// prefix.
+func (x *exprPath) childOnly() (*selectChildrenByTag, bool) {
+	if len(x.segments) != 1 || x.attr != nil || x.node != "" || len(x.segments[0].filters) > 0 {
+		return nil, false
+	}
+	s, ok := x.segments[0].sel.(*selectChildrenByTag)
+	if !ok || s.tag == "*" || s.resolved {
+		return nil, false
+	}
+	return s, true
+}
+
+// exprUnion selects the union of the node sets selected by two or more
+// location paths. Elements in the union are kept in document order.
+type exprUnion struct {
+	paths []expr
+}
+
+func (x *exprUnion) eval(ctx *evalContext) value {
+	var u nodeSet
+	seen := make(map[any]bool)
+	for _, p := range x.paths {
+		n, _ := p.eval(ctx).(nodeSet)
+		for _, e := range n.elements {
+			if !seen[e] {
+				seen[e] = true
+				u.elements = append(u.elements, e)
+			}
+		}
+		for _, a := range n.attrs {
+			if !seen[a] {
+				seen[a] = true
+				u.attrs = append(u.attrs, a)
+			}
+		}
+		for _, c := range n.charData {
+			if !seen[c] {
+				seen[c] = true
+				u.charData = append(u.charData, c)
+			}
+		}
+		for _, c := range n.comments {
+			if !seen[c] {
+				seen[c] = true
+				u.comments = append(u.comments, c)
+			}
+		}
+	}
+	sortDocumentOrder(u.elements)
+	return u
+}
+
+func (x *exprUnion) String() string {
+	parts := make([]string, len(x.paths))
+	for i, p := range x.paths {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, " | ")
+}
+
+// exprVar refers to the value bound to a variable.
+type exprVar struct {
+	name string
+}
+
+func (x *exprVar) eval(ctx *evalContext) value {
+	v, ok := ctx.vars[x.name]
+	if !ok {
+		return nodeSet{}
+	}
+	return toValue(v)
+}
+
+func (x *exprVar) String() string {
+	return "$" + x.name
+}
+
+// exprCall calls a function.
+type exprCall struct {
+	name string
+	fn   function
+	args []expr
+}
+
+func (x *exprCall) eval(ctx *evalContext) value {
+	args := make([]value, len(x.args))
+	for i, a := range x.args {
+		args[i] = a.eval(ctx)
+	}
+	return x.fn.call(ctx, args)
+}
+
+func (x *exprCall) String() string {
+	args := make([]string, len(x.args))
+	for i, a := range x.args {
+		args[i] = a.String()
+	}
+	return x.name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// A function may be called from within a filter expression.
+type function struct {
+	minArgs, maxArgs int // maxArgs is -1 if the function is variadic
+	call             func(ctx *evalContext, args []value) value
+}
+
+// customFunction creates a function calling the custom path function 'f'.
+func customFunction(f PathFunc) function {
+	return function{0, -1, func(ctx *evalContext, args []value) value {
+		results := make([]PathResult, len(args))
+		for i, a := range args {
+			results[i] = newPathResult(a)
+		}
+		return toValue(f(ctx.e, results))
+	}}
+}
+
+// elementFunction creates a function calling the element function 'f' on
+// the candidate element.
+func elementFunction(f func(e *Element) string) function {
+	return function{0, 0, func(ctx *evalContext, args []value) value {
+		return f(ctx.e)
+	}}
+}
+
+// functions contains all functions that may be called from within a filter
+// expression.
+var functions = map[string]function{
+	"boolean": {1, 1, func(ctx *evalContext, args []value) value {
+		return toBoolean(args[0])
+	}},
+	"concat": {2, -1, func(ctx *evalContext, args []value) value {
+		var b strings.Builder
+		for _, a := range args {
+			b.WriteString(toString(a))
+		}
+		return b.String()
+	}},
+	"count": {1, 1, func(ctx *evalContext, args []value) value {
+		n, _ := args[0].(nodeSet)
+		return float64(n.len())
+	}},
+	"contains": {2, 2, func(ctx *evalContext, args []value) value {
+		return strings.Contains(toString(args[0]), toString(args[1]))
+	}},
+	"ends-with": {2, 2, func(ctx *evalContext, args []value) value {
+		return strings.HasSuffix(toString(args[0]), toString(args[1]))
+	}},
+	"false": {0, 0, func(ctx *evalContext, args []value) value {
+		return false
+	}},
+	"last": {0, 0, func(ctx *evalContext, args []value) value {
+		return float64(ctx.size)
+	}},
+	"lower-case": {0, 1, func(ctx *evalContext, args []value) value {
+		return strings.ToLower(stringArg(ctx, args))
+	}},
+	"normalize-space": {0, 1, func(ctx *evalContext, args []value) value {
+		return strings.Join(strings.Fields(stringArg(ctx, args)), " ")
+	}},
+	"not": {1, 1, func(ctx *evalContext, args []value) value {
+		return !toBoolean(args[0])
+	}},
+	"number": {0, 1, func(ctx *evalContext, args []value) value {
+		if len(args) == 0 {
+			return stringToNumber(ctx.e.Text())
+		}
+		return toNumber(args[0])
+	}},
+	"position": {0, 0, func(ctx *evalContext, args []value) value {
+		return float64(ctx.pos)
+	}},
+	"starts-with": {2, 2, func(ctx *evalContext, args []value) value {
+		return strings.HasPrefix(toString(args[0]), toString(args[1]))
+	}},
+	"string": {0, 1, func(ctx *evalContext, args []value) value {
+		return stringArg(ctx, args)
+	}},
+	"string-length": {0, 1, func(ctx *evalContext, args []value) value {
+		return float64(utf8.RuneCountInString(stringArg(ctx, args)))
+	}},
+	"substring": {2, 3, func(ctx *evalContext, args []value) value {
+		return substring(toString(args[0]), args[1:])
+	}},
+	"substring-after": {2, 2, func(ctx *evalContext, args []value) value {
+		_, after, found := strings.Cut(toString(args[0]), toString(args[1]))
+		if !found {
+			return ""
+		}
+		return after
+	}},
+	"substring-before": {2, 2, func(ctx *evalContext, args []value) value {
+		before, _, found := strings.Cut(toString(args[0]), toString(args[1]))
+		if !found {
+			return ""
+		}
+		return before
+	}},
+	"translate": {3, 3, func(ctx *evalContext, args []value) value {
+		return translate(toString(args[0]), toString(args[1]), toString(args[2]))
+	}},
+	"true": {0, 0, func(ctx *evalContext, args []value) value {
+		return true
+	}},
+	"upper-case": {0, 1, func(ctx *evalContext, args []value) value {
+		return strings.ToUpper(stringArg(ctx, args))
+	}},
+}
+
+// stringArg returns the string value of a function's only argument. If the
+// function was called without arguments, it returns the candidate element's
+// text instead.
+func stringArg(ctx *evalContext, args []value) string {
+	if len(args) == 0 {
+		return ctx.e.Text()
+	}
+	return toString(args[0])
+}
+
+// round rounds a number to the nearest integer, rounding halves toward
+// positive infinity.
+func round(f float64) float64 {
+	return math.Floor(f + 0.5)
+}
+
+// substring returns the characters of s starting at the 1-based position
+// given by the first argument. If a second argument is provided, it limits
+// the number of characters returned.
+func substring(s string, args []value) string {
+	start := round(toNumber(args[0]))
+	end := math.Inf(1)
+	if len(args) > 1 {
+		end = start + round(toNumber(args[1]))
+	}
+
+	var b strings.Builder
+	pos := 1.0
+	for _, r := range s {
+		if pos >= start && pos < end {
+			b.WriteRune(r)
+		}
+		pos++
+	}
+	return b.String()
+}
+
+// translate returns s with each character appearing in 'from' replaced by
+// the character at the same position in 'to'. Characters in 'from' without
+// a corresponding character in 'to' are removed.
+func translate(s, from, to string) string {
+	toRunes := []rune(to)
+	mapping := make(map[rune]rune)
+	i := 0
+	for _, r := range from {
+		if _, ok := mapping[r]; !ok {
+			if i < len(toRunes) {
+				mapping[r] = toRunes[i]
+			} else {
+				mapping[r] = -1
+			}
+		}
+		i++
+	}
+	return strings.Map(func(r rune) rune {
+		if m, ok := mapping[r]; ok {
+			return m
+		}
+		return r
+	}, s)
+}
+
+func init() {
+	// Element functions from the function table operate on the candidate
+	// element.
+	for name, fn := range fnTable {
+		functions[name] = elementFunction(fn)
+	}
+}
+
+// filterExpr filters the candidate list for elements satisfying a filter
+// expression. If the expression produces a number, only the candidate at
+// that position is kept.
+type filterExpr struct {
+	x expr
+}
+
+func (f *filterExpr) apply(p *pather) {
+	ctx := evalContext{size: len(p.candidates), vars: p.vars}
+	for i, c := range p.candidates {
+		ctx.e, ctx.pos = c, i+1
+		v := f.x.eval(&ctx)
+		if n, ok := v.(float64); ok {
+			v = n == float64(ctx.pos)
+		}
+		if toBoolean(v) {
+			p.scratch = append(p.scratch, c)
+		}
+	}
+	p.candidates, p.scratch = p.scratch, p.candidates[0:0]
+}
+
+func (f *filterExpr) String() string {
+	return f.x.String()
+}
@@ -0,0 +1,375 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package etree
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// A StreamReader reads an XML document from an input stream one element
+// subtree at a time. Only elements matching the stream reader's path are
+// fully built in memory; all other elements are retained only while they
+// are open, and are discarded as soon as their end tags are read. This keeps
+// memory usage bounded by the size of a single matching element rather than
+// by the size of the entire document.
+//
+// The stream reader's path is evaluated relative to the document, as though
+// it had been passed to the Document's FindElements function. Filters of the
+// path's last step that test an element's child elements or text, such as
+// [title='x'], are evaluated once the element has been read in its
+// entirety, so each element satisfying the path's other filters is built
+// in memory until then. All other filters are evaluated when an element's start tag is
+// read, so the filters of earlier steps may test the attributes of the
+// element's ancestors, but not their child elements or text. Nor may any
+// filter test an element's position among its siblings, since the siblings
+// preceding it have already been discarded and those following it have not
+// yet been read.
+type StreamReader struct {
+	tr       *treeReader
+	path     Path
+	start    Path // path without the filters testing element content
+	deferred bool // true if start differs from path
+	doc      *Document
+	stack    stack[*Element]
+	record   *Element     // element currently being built, if any
+	ready    []*Element   // matching elements not yet returned
+	pending  *streamToken // token read but not yet processed
+	err      error        // sticky error
+}
+
+// A streamToken holds the result of a single token read.
+type streamToken struct {
+	t   xml.Token
+	err error
+}
+
+// NewStreamReader creates a stream reader that reads XML from the reader
+// 'r' using the provided read settings. Each call to the stream reader's
+// Next function returns the next element matching 'path'. The settings'
+// ValidateInput option is ignored, since validation would require the entire
+// input to be read in advance. An ErrPath is returned if the path contains a
+// positional filter, such as [2], [last()] or [position() > 1], or if a step
+// other than its last contains a filter testing the child elements or text
+// of an element, such as [title] or [text()='x'].
+func NewStreamReader(r io.Reader, path Path, settings ReadSettings) (*StreamReader, error) {
+	if f := positionalFilter(path); f != "" {
+		return nil, ErrPath("stream reader paths may not contain positional filter [" + f + "]")
+	}
+	if f := contentFilter(path); f != "" {
+		return nil, ErrPath("stream reader paths may not contain content filter [" + f + "] before their last step")
+	}
+
+	s := &StreamReader{
+		tr:   newTreeReader(r, settings),
+		path: path,
+		doc:  NewDocument(),
+	}
+	s.start, s.deferred = withoutContentFilters(path)
+	s.doc.ReadSettings = settings
+	s.stack.push(&s.doc.Element)
+	return s, nil
+}
+
+// positionalFilter returns the first filter of the path that tests the
+// position of elements among the path's candidates, or the empty string if
+// there is none. Filters calling custom functions that return numbers are not
+// detected.
+func positionalFilter(path Path) string {
+	for _, segments := range segmentLists(path) {
+		for _, seg := range segments {
+			for _, f := range seg.filters {
+				switch f := f.(type) {
+				case *filterPos:
+					return f.String()
+				case *filterExpr:
+					if isNumeric(f.x, path.vars) || callsPosition(f.x) {
+						return f.String()
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// contentFilter returns the first filter of the path that tests the child
+// elements or text of an element selected before the path's last step, or
+// the empty string if there is none. Every step of a path expression, such
+// as one selecting attributes, is checked.
+func contentFilter(path Path) string {
+	for _, segments := range segmentLists(path) {
+		if path.x == nil {
+			segments = segments[:len(segments)-1]
+		}
+		for _, seg := range segments {
+			for _, f := range seg.filters {
+				if testsContent(f) {
+					return f.String()
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// withoutContentFilters returns a copy of the path without the filters of
+// its last step that test the child elements or text of an element, and
+// true if there were any.
+func withoutContentFilters(path Path) (Path, bool) {
+	if path.x != nil {
+		return path, false
+	}
+
+	start, removed := path, false
+	start.paths = make([][]segment, len(path.paths))
+	for i, segments := range path.paths {
+		n := len(segments) - 1
+		last := segment{sel: segments[n].sel}
+		for _, f := range segments[n].filters {
+			if testsContent(f) {
+				removed = true
+			} else {
+				last.filters = append(last.filters, f)
+			}
+		}
+		start.paths[i] = append(segments[:n:n], last)
+	}
+	return start, removed
+}
+
+// segmentLists returns the segments of each location path of the path,
+// including those within a path expression.
+func segmentLists(path Path) [][]segment {
+	switch x := path.x.(type) {
+	case *exprPath:
+		return [][]segment{x.segments}
+	case *exprUnion:
+		var paths [][]segment
+		for _, p := range x.paths {
+			if p, ok := p.(*exprPath); ok {
+				paths = append(paths, p.segments)
+			}
+		}
+		return paths
+	}
+	return path.paths
+}
+
+// testsContent returns true if the filter may test the child elements or
+// text of the candidate element.
+func testsContent(f filter) bool {
+	switch f := f.(type) {
+	case *filterPos, *filterAttr, *filterAttrVal:
+		return false
+	case *filterFunc:
+		return f.name == "text"
+	case *filterFuncVal:
+		return f.name == "text"
+	case *filterExpr:
+		return exprTestsContent(f.x)
+	}
+	return true
+}
+
+// exprTestsContent returns true if the filter expression may test the
+// child elements or text of the candidate element. Only attribute selectors
+// (@attrib) and functions of the element's name and position are known not
+// to.
+func exprTestsContent(x expr) bool {
+	switch x := x.(type) {
+	case *exprLiteral, *exprNumber, *exprVar:
+		return false
+	case *exprNegate:
+		return exprTestsContent(x.x)
+	case *exprBinary:
+		return exprTestsContent(x.left) || exprTestsContent(x.right)
+	case *exprPath:
+		return len(x.segments) > 0 || x.attr == nil
+	case *exprCall:
+		if _, ok := functions[x.name]; !ok {
+			return true // custom functions are passed the candidate element
+		}
+		if len(x.args) == 0 {
+			switch x.name {
+			case "false", "last", "local-name", "name", "namespace-prefix",
+				"namespace-uri", "position", "true":
+				return false
+			}
+			return true
+		}
+		for _, a := range x.args {
+			if exprTestsContent(a) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// isNumeric returns true if the filter expression produces a number, which
+// selects the candidate at that position.
+func isNumeric(x expr, vars map[string]any) bool {
+	switch x := x.(type) {
+	case *exprNumber, *exprNegate:
+		return true
+	case *exprBinary:
+		switch x.op {
+		case "+", "-", "*", "div", "mod":
+			return true
+		}
+	case *exprCall:
+		switch x.name {
+		case "count", "last", "number", "position", "string-length":
+			return true
+		}
+	case *exprVar:
+		_, ok := toValue(vars[x.name]).(float64)
+		return ok
+	}
+	return false
+}
+
+// callsPosition returns true if the filter expression calls the position or
+// last function, other than within a relative path.
+func callsPosition(x expr) bool {
+	switch x := x.(type) {
+	case *exprNegate:
+		return callsPosition(x.x)
+	case *exprBinary:
+		return callsPosition(x.left) || callsPosition(x.right)
+	case *exprCall:
+		if x.name == "position" || x.name == "last" {
+			return true
+		}
+		for _, a := range x.args {
+			if callsPosition(a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Next reads from the input stream until the next element matching the
+// stream reader's path has been read in its entirety, and then returns it.
+// The returned element has no parent; it may be freely modified or added to
+// another document. When the end of the input stream is reached, Next
+// returns io.EOF.
+func (s *StreamReader) Next() (*Element, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	settings := &s.tr.settings
+	for {
+		if len(s.ready) > 0 {
+			e := s.ready[0]
+			s.ready = s.ready[1:]
+			return e, nil
+		}
+
+		var t xml.Token
+		var err error
+		if s.pending != nil {
+			t, err = s.pending.t, s.pending.err
+			s.pending = nil
+		} else {
+			t, err = s.tr.token()
+			if settings.Permissive && settings.AutoClose != nil && !s.stack.empty() {
+				top := s.stack.peek()
+				s.doc.autoClose(&s.stack, t, settings.AutoClose)
+				if s.stack.empty() || s.stack.peek() != top {
+					s.finish(top)
+					if len(s.ready) > 0 {
+						s.pending = &streamToken{t, err}
+						continue
+					}
+				}
+			}
+		}
+
+		switch {
+		case err == io.EOF:
+			if len(s.stack.data) != 1 {
+				s.err = s.tr.parseError(&s.stack, nil)
+			} else {
+				s.err = io.EOF
+			}
+			return nil, s.err
+		case err != nil:
+			s.err = err
+			return nil, err
+		case s.stack.empty():
+			s.err = s.tr.parseError(&s.stack, t)
+			return nil, s.err
+		}
+
+		top := s.stack.peek()
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			e := s.tr.newElement(t, top)
+			if s.record == nil && s.start.Matches(e) {
+				s.record = e
+			}
+			s.stack.push(e)
+
+		case xml.EndElement:
+			if top.Tag != t.Name.Local || top.Space != t.Name.Space {
+				s.err = s.tr.parseError(&s.stack, t)
+				return nil, s.err
+			}
+			top.pos.End = s.tr.span().End
+			s.stack.pop()
+			s.finish(top)
+
+		default:
+			if s.record != nil {
+				s.tr.newToken(t, top)
+			}
+		}
+	}
+}
+
+// finish is called after element 'e' has been closed. If 'e' is the element
+// being built, it is detached and queued to be returned if it matches the
+// stream reader's path. If it fails a filter that could only be evaluated
+// once it was complete, the matching elements it contains are queued
+// instead. Otherwise, 'e' is discarded unless it is part of the element
+// being built.
+func (s *StreamReader) finish(e *Element) {
+	switch {
+	case e == s.record:
+		s.record = nil
+		if !s.deferred || s.path.Matches(e) {
+			s.ready = append(s.ready, e)
+		} else {
+			matches := s.matchesWithin(e, nil)
+			for _, m := range matches {
+				m.Parent().RemoveChild(m)
+			}
+			s.ready = append(s.ready, matches...)
+		}
+		e.Parent().RemoveChild(e)
+	case s.record == nil:
+		e.Parent().RemoveChild(e)
+	}
+}
+
+// matchesWithin appends to 'matches' the descendants of element 'e' that
+// match the stream reader's path, in document order, omitting those within
+// another matching element.
+func (s *StreamReader) matchesWithin(e *Element, matches []*Element) []*Element {
+	for _, c := range e.ChildElements() {
+		if s.path.Matches(c) {
+			matches = append(matches, c)
+		} else {
+			matches = s.matchesWithin(c, matches)
+		}
+	}
+	return matches
+}
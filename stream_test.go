@@ -0,0 +1,202 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package etree
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func readStream(t *testing.T, s string, path string, settings ReadSettings) ([]*Element, error) {
+	t.Helper()
+	sr, err := NewStreamReader(strings.NewReader(s), MustCompilePath(path), settings)
+	if err != nil {
+		return nil, err
+	}
+	var elements []*Element
+	for {
+		e, err := sr.Next()
+		if err == io.EOF {
+			return elements, nil
+		}
+		if err != nil {
+			return elements, err
+		}
+		elements = append(elements, e)
+	}
+}
+
+func TestStreamReader(t *testing.T) {
+	s := `<?xml version="1.0"?>
+<feed>
+	<title>Feed</title>
+	<entry id="1"><title>One</title><!--c--></entry>
+	<group>
+		<entry id="2"><title>Two</title><entry id="nested"/></entry>
+	</group>
+	<entry id="3"><title>Three</title></entry>
+</feed>`
+
+	cases := []struct {
+		path string
+		ids  []string
+	}{
+		{"/feed/entry", []string{"1", "3"}},
+		{"//entry", []string{"1", "2", "3"}},
+		{"/feed/group/entry", []string{"2"}},
+		{"//entry[@id='3']", []string{"3"}},
+		{"//missing", nil},
+	}
+
+	for _, c := range cases {
+		elements, err := readStream(t, s, c.path, ReadSettings{})
+		if err != nil {
+			t.Fatalf("etree: stream read of '%s' failed: %v", c.path, err)
+		}
+		checkIntEq(t, len(elements), len(c.ids))
+		for i := 0; i < len(elements) && i < len(c.ids); i++ {
+			e := elements[i]
+			checkStrEq(t, e.SelectAttrValue("id", ""), c.ids[i])
+			if e.Parent() != nil {
+				t.Errorf("etree: streamed element should have no parent")
+			}
+		}
+	}
+
+	elements, _ := readStream(t, s, "/feed/entry", ReadSettings{})
+	doc := NewDocumentWithRoot(elements[0])
+	str, _ := doc.WriteToString()
+	checkStrEq(t, str, `<entry id="1"><title>One</title><!--c--></entry>`)
+
+	elements, _ = readStream(t, s, "//entry", ReadSettings{})
+	checkIntEq(t, len(elements[1].ChildElements()), 2)
+}
+
+func TestStreamReaderDiscardsUnmatched(t *testing.T) {
+	s := `<feed><junk><a/><b/></junk><entry/>text<entry/></feed>`
+	sr, err := NewStreamReader(strings.NewReader(s), MustCompilePath("/feed/entry"), ReadSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := sr.Next(); err != nil {
+			t.Fatalf("etree: stream read failed: %v", err)
+		}
+		feed := sr.doc.Root()
+		checkIntEq(t, len(feed.Child), 0)
+	}
+	if _, err := sr.Next(); err != io.EOF {
+		t.Errorf("etree: expected io.EOF, got %v", err)
+	}
+	if _, err := sr.Next(); err != io.EOF {
+		t.Errorf("etree: expected sticky io.EOF, got %v", err)
+	}
+}
+
+func TestStreamReaderErrors(t *testing.T) {
+	cases := []string{
+		`<feed><entry></feed>`,
+		`<feed><entry/>`,
+	}
+	for _, c := range cases {
+		_, err := readStream(t, c, "//entry", ReadSettings{})
+		if !errors.Is(err, ErrXML) {
+			t.Errorf("etree: expected ErrXML for '%s', got %v", c, err)
+		}
+	}
+}
+
+func TestStreamReaderPositionalFilters(t *testing.T) {
+	s := `<feed><entry/><entry/></feed>`
+	paths := []string{
+		"/feed/entry[2]",
+		"/feed/entry[last()]",
+		"//entry[position() > 1]",
+		"//entry[1 + 1]",
+		"//entry[$n]",
+		"/feed[@a]/entry[not(position() = 1)]",
+	}
+	for _, p := range paths {
+		path := MustCompilePath(p).WithVariables(map[string]any{"n": 2})
+		_, err := NewStreamReader(strings.NewReader(s), path, ReadSettings{})
+		var errPath ErrPath
+		if !errors.As(err, &errPath) {
+			t.Errorf("etree: expected ErrPath for '%s', got %v", p, err)
+		}
+	}
+
+	path := MustCompilePath("//entry[$n]").WithVariables(map[string]any{"n": "x"})
+	if _, err := NewStreamReader(strings.NewReader(s), path, ReadSettings{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStreamReaderContentFilters(t *testing.T) {
+	s := `<feed>
+	<entry id="1"><title>x</title></entry>
+	<entry id="2"><title>y</title><entry id="3"><title>x</title></entry></entry>
+	<entry id="4"/>
+	<entry id="5"><title>x</title><entry id="6"><title>x</title></entry></entry>
+</feed>`
+
+	cases := []struct {
+		path string
+		ids  []string
+	}{
+		{"/feed/entry[title='x']", []string{"1", "5"}},
+		{"//entry[title='x']", []string{"1", "3", "5"}},
+		{"//entry[title]", []string{"1", "2", "5"}},
+		{"//entry[not(title)]", []string{"4"}},
+		{"//entry[@id > 1][title/text()='x']", []string{"3", "5"}},
+		{"//entry[count(entry) = 1]", []string{"2", "5"}},
+		{"//title[.='y']", []string{""}},
+	}
+	for _, c := range cases {
+		elements, err := readStream(t, s, c.path, ReadSettings{})
+		if err != nil {
+			t.Errorf("etree: stream read of '%s' failed: %v", c.path, err)
+			continue
+		}
+		var ids []string
+		for _, e := range elements {
+			ids = append(ids, e.SelectAttrValue("id", ""))
+		}
+		checkStrEq(t, strings.Join(ids, ","), strings.Join(c.ids, ","))
+	}
+
+	// Content filters before the last step are rejected.
+	for _, p := range []string{"/feed[entry]/entry", "//entry[title='x']/title", "//entry[text()]/@id"} {
+		_, err := NewStreamReader(strings.NewReader(s), MustCompilePath(p), ReadSettings{})
+		var errPath ErrPath
+		if !errors.As(err, &errPath) {
+			t.Errorf("etree: expected ErrPath for '%s', got %v", p, err)
+		}
+	}
+}
+
+func TestStreamReaderSettings(t *testing.T) {
+	s := `<p><e>a<br>b</e><e><![CDATA[x]]></e></p>`
+	settings := ReadSettings{
+		Permissive:    true,
+		AutoClose:     xml.HTMLAutoClose,
+		PreserveCData: true,
+	}
+	elements, err := readStream(t, s, "//e", settings)
+	if err != nil {
+		t.Fatalf("etree: stream read failed: %v", err)
+	}
+	checkIntEq(t, len(elements), 2)
+	checkIntEq(t, len(elements[0].Child), 3)
+	checkBoolEq(t, elements[1].Child[0].(*CharData).IsCData(), true)
+
+	breaks, err := readStream(t, `<p>a<br>b<br></p>`, "//br", settings)
+	if err != nil {
+		t.Fatalf("etree: stream read failed: %v", err)
+	}
+	checkIntEq(t, len(breaks), 2)
+}
@@ -0,0 +1,254 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmldsig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/beevik/etree"
+)
+
+// A Signer creates XML signatures.
+type Signer struct {
+	// Key signs the canonicalized SignedInfo element of each signature.
+	// RSA and ECDSA keys are supported. Required.
+	Key crypto.Signer
+
+	// Certificates holds DER-encoded X.509 certificates added to the
+	// signature's KeyInfo element, typically starting with the certificate
+	// of Key. Default: nil.
+	Certificates [][]byte
+
+	// Hash is the hash function used for digests and signatures. It must be
+	// crypto.SHA256, crypto.SHA384 or crypto.SHA512. Default:
+	// crypto.SHA256.
+	Hash crypto.Hash
+
+	// Canonicalization is the identifier of the canonicalization algorithm
+	// applied to the SignedInfo element and to the signed content. Default:
+	// ExcC14N.
+	Canonicalization string
+
+	// Prefix is the namespace prefix of the created signature elements.
+	// Default: "ds".
+	Prefix string
+
+	// IDAttributes lists the names of the attributes identifying signed
+	// elements, checked in order. Default: "ID", "Id" and "id".
+	IDAttributes []string
+}
+
+// SignEnveloped signs the element e and adds the Signature element as its
+// last child. The signature refers to e by the value of its first ID
+// attribute or, if e has none but is the root of its document or element
+// tree, to the whole document. The signature includes the enveloped
+// signature transform, so it remains valid if moved elsewhere within e.
+// The function returns the Signature element.
+func (s *Signer) SignEnveloped(e *etree.Element) (*etree.Element, error) {
+	uri := ""
+	if id := s.id(e); id != "" {
+		uri = "#" + id
+	} else if p := e.Parent(); p != nil && !isDocument(p) {
+		return nil, fmt.Errorf("xmldsig: element %s has no ID attribute", e.FullTag())
+	}
+
+	sig, err := s.newSignature(uri, EnvelopedSignature)
+	if err != nil {
+		return nil, err
+	}
+	e.AddChild(sig)
+	if err := s.sign(sig); err != nil {
+		e.RemoveChild(sig)
+		return nil, err
+	}
+	return sig, nil
+}
+
+// SignEnveloping creates a Signature element containing an Object element
+// with the specified 'id', moves the element 'content' into the Object
+// element and signs it. The id is the value of the Object element's Id
+// attribute or, if the signer's ID attributes don't include Id, of the
+// first of them. If signing fails, 'content' is returned to its original
+// parent. The function returns the Signature element.
+func (s *Signer) SignEnveloping(content *etree.Element, id string) (*etree.Element, error) {
+	idAttrs := s.idAttributes()
+	if len(idAttrs) == 0 {
+		return nil, errors.New("xmldsig: signer has no ID attributes")
+	}
+	idAttr := idAttrs[0]
+	for _, key := range idAttrs {
+		if key == "Id" {
+			idAttr = key
+		}
+	}
+
+	sig, err := s.newSignature("#" + id)
+	if err != nil {
+		return nil, err
+	}
+	object := sig.CreateElement(s.tag("Object"))
+	object.CreateAttr(idAttr, id)
+	parent, index := content.Parent(), content.Index()
+	object.AddChild(content)
+	if err := s.sign(sig); err != nil {
+		if parent != nil {
+			parent.InsertChildAt(index, content)
+		} else {
+			object.RemoveChild(content)
+		}
+		return nil, err
+	}
+	return sig, nil
+}
+
+// id returns the value of the element's first ID attribute.
+func (s *Signer) id(e *etree.Element) string {
+	for _, key := range s.idAttributes() {
+		for _, a := range e.Attr {
+			if a.Key == key {
+				return a.Value
+			}
+		}
+	}
+	return ""
+}
+
+func (s *Signer) idAttributes() []string {
+	if s.IDAttributes == nil {
+		return defaultIDAttributes
+	}
+	return s.IDAttributes
+}
+
+func (s *Signer) tag(tag string) string {
+	if s.Prefix == "" {
+		return "ds:" + tag
+	}
+	return s.Prefix + ":" + tag
+}
+
+// methods returns the identifiers of the signer's digest and signature
+// algorithms.
+func (s *Signer) methods() (digest, signature string, err error) {
+	if s.Key == nil {
+		return "", "", errors.New("xmldsig: signer has no key")
+	}
+
+	hash := s.Hash
+	if hash == 0 {
+		hash = crypto.SHA256
+	}
+	var isECDSA bool
+	switch s.Key.Public().(type) {
+	case *rsa.PublicKey:
+	case *ecdsa.PublicKey:
+		isECDSA = true
+	default:
+		return "", "", fmt.Errorf("%w: key type %T", ErrUnsupportedAlgorithm, s.Key.Public())
+	}
+
+	for uri, h := range digestMethods {
+		if h == hash {
+			digest = uri
+		}
+	}
+	for uri, m := range signatureMethods {
+		if m.hash == hash && m.ecdsa == isECDSA {
+			signature = uri
+		}
+	}
+	if digest == "" || signature == "" {
+		return "", "", fmt.Errorf("%w: hash %v", ErrUnsupportedAlgorithm, hash)
+	}
+	return digest, signature, nil
+}
+
+// newSignature creates an unsigned Signature element with a single
+// reference to the URI, applying the listed transforms followed by the
+// signer's canonicalization.
+func (s *Signer) newSignature(uri string, transforms ...string) (*etree.Element, error) {
+	digest, signature, err := s.methods()
+	if err != nil {
+		return nil, err
+	}
+	c14n := s.Canonicalization
+	if c14n == "" {
+		c14n = ExcC14N
+	}
+
+	sig := etree.NewElement(s.tag("Signature"))
+	sig.CreateAttr("xmlns:"+sig.Space, Namespace)
+
+	signedInfo := sig.CreateElement(s.tag("SignedInfo"))
+	signedInfo.CreateElement(s.tag("CanonicalizationMethod")).CreateAttr("Algorithm", c14n)
+	signedInfo.CreateElement(s.tag("SignatureMethod")).CreateAttr("Algorithm", signature)
+
+	ref := signedInfo.CreateElement(s.tag("Reference"))
+	ref.CreateAttr("URI", uri)
+	t := ref.CreateElement(s.tag("Transforms"))
+	for _, alg := range append(transforms, c14n) {
+		t.CreateElement(s.tag("Transform")).CreateAttr("Algorithm", alg)
+	}
+	ref.CreateElement(s.tag("DigestMethod")).CreateAttr("Algorithm", digest)
+	ref.CreateElement(s.tag("DigestValue"))
+
+	sig.CreateElement(s.tag("SignatureValue"))
+	if len(s.Certificates) > 0 {
+		data := sig.CreateElement(s.tag("KeyInfo")).CreateElement(s.tag("X509Data"))
+		for _, cert := range s.Certificates {
+			data.CreateElement(s.tag("X509Certificate")).SetText(base64.StdEncoding.EncodeToString(cert))
+		}
+	}
+	return sig, nil
+}
+
+// sign computes the digests of the signature's references, and then
+// computes and stores the signature value. The signature must already be
+// placed in its final position within the element tree.
+func (s *Signer) sign(sig *etree.Element) error {
+	signedInfo := child(sig, "SignedInfo")
+	for _, ref := range children(signedInfo, "Reference") {
+		_, digest, err := referenceDigest(sig, ref, s.idAttributes())
+		if err != nil {
+			return err
+		}
+		child(ref, "DigestValue").SetText(base64.StdEncoding.EncodeToString(digest))
+	}
+
+	alg, _ := algorithm(signedInfo, "SignatureMethod")
+	method := signatureMethods[alg]
+	digest, err := signedInfoDigest(signedInfo, method.hash)
+	if err != nil {
+		return err
+	}
+	value, err := s.Key.Sign(rand.Reader, digest, method.hash)
+	if err != nil {
+		return err
+	}
+
+	// XML signatures encode ECDSA signatures as the concatenation of the
+	// fixed-size r and s values rather than in ASN.1 form.
+	if pub, ok := s.Key.Public().(*ecdsa.PublicKey); ok {
+		var rs struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(value, &rs); err != nil {
+			return err
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		value = make([]byte, 2*size)
+		rs.R.FillBytes(value[:size])
+		rs.S.FillBytes(value[size:])
+	}
+
+	child(sig, "SignatureValue").SetText(base64.StdEncoding.EncodeToString(value))
+	return nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmldsig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+
+	"github.com/beevik/etree"
+)
+
+// A Verifier verifies XML signatures.
+type Verifier struct {
+	// Key is the public key expected to have produced the signatures. It
+	// must be an *rsa.PublicKey or an *ecdsa.PublicKey. To verify a
+	// signature made with a trusted certificate, use the certificate's
+	// PublicKey. Required.
+	Key crypto.PublicKey
+
+	// IDAttributes lists the names of the attributes identifying the
+	// elements referenced by signatures. Default: "ID", "Id" and "id".
+	IDAttributes []string
+}
+
+// Verify verifies the Signature element 'sig'. It checks the signature
+// value of the SignedInfo element using the verifier's key, and then checks
+// the digest of each reference. On success, it returns the referenced
+// elements in the order of the signature's references. A reference to the
+// whole document is returned as the document's root element. Only the
+// returned elements are covered by the signature.
+func (v *Verifier) Verify(sig *etree.Element) ([]*etree.Element, error) {
+	if sig.Tag != "Signature" || sig.NamespaceURI() != Namespace {
+		return nil, fmt.Errorf("%w: %s is not a Signature element", ErrMalformedSignature, sig.FullTag())
+	}
+	signedInfo, err := requireChild(sig, "SignedInfo")
+	if err != nil {
+		return nil, err
+	}
+	signatureValue, err := requireChild(sig, "SignatureValue")
+	if err != nil {
+		return nil, err
+	}
+
+	alg, err := algorithm(signedInfo, "SignatureMethod")
+	if err != nil {
+		return nil, err
+	}
+	method, ok := signatureMethods[alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, alg)
+	}
+	digest, err := signedInfoDigest(signedInfo, method.hash)
+	if err != nil {
+		return nil, err
+	}
+	value, err := decodeBase64(signatureValue.Text())
+	if err != nil {
+		return nil, err
+	}
+	if err := v.verifySignature(method, digest, value); err != nil {
+		return nil, err
+	}
+
+	refs := children(signedInfo, "Reference")
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("%w: SignedInfo has no Reference element", ErrMalformedSignature)
+	}
+	idAttrs := v.IDAttributes
+	if idAttrs == nil {
+		idAttrs = defaultIDAttributes
+	}
+
+	var elements []*etree.Element
+	for _, ref := range refs {
+		target, digest, err := referenceDigest(sig, ref, idAttrs)
+		if err != nil {
+			return nil, err
+		}
+		digestValue, err := requireChild(ref, "DigestValue")
+		if err != nil {
+			return nil, err
+		}
+		want, err := decodeBase64(digestValue.Text())
+		if err != nil {
+			return nil, err
+		}
+		if subtle.ConstantTimeCompare(digest, want) != 1 {
+			return nil, fmt.Errorf("%w: reference %q", ErrDigestMismatch, ref.SelectAttrValue("URI", ""))
+		}
+
+		if isDocument(target) {
+			target = rootElement(target)
+		}
+		elements = append(elements, target)
+	}
+	return elements, nil
+}
+
+// VerifyDocument verifies every Signature element in the document. On
+// success, it returns the elements referenced by the signatures, as
+// described for Verify.
+func (v *Verifier) VerifyDocument(doc *etree.Document) ([]*etree.Element, error) {
+	var sigs []*etree.Element
+	var visit func(e *etree.Element)
+	visit = func(e *etree.Element) {
+		for _, c := range e.ChildElements() {
+			if c.Tag == "Signature" && c.NamespaceURI() == Namespace {
+				sigs = append(sigs, c)
+				continue
+			}
+			visit(c)
+		}
+	}
+	visit(&doc.Element)
+	if len(sigs) == 0 {
+		return nil, ErrSignatureNotFound
+	}
+
+	var elements []*etree.Element
+	for _, sig := range sigs {
+		e, err := v.Verify(sig)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, e...)
+	}
+	return elements, nil
+}
+
+// verifySignature checks the signature value of the SignedInfo element's
+// digest using the verifier's key.
+func (v *Verifier) verifySignature(method signatureMethod, digest, value []byte) error {
+	switch key := v.Key.(type) {
+	case *rsa.PublicKey:
+		if method.ecdsa {
+			return fmt.Errorf("%w: signature method requires an ECDSA key", ErrInvalidSignature)
+		}
+		if rsa.VerifyPKCS1v15(key, method.hash, digest, value) != nil {
+			return ErrInvalidSignature
+		}
+	case *ecdsa.PublicKey:
+		if !method.ecdsa {
+			return fmt.Errorf("%w: signature method requires an RSA key", ErrInvalidSignature)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(value) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(value[:size])
+		s := new(big.Int).SetBytes(value[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return ErrInvalidSignature
+		}
+	default:
+		return fmt.Errorf("%w: key type %T", ErrUnsupportedAlgorithm, v.Key)
+	}
+	return nil
+}
+
+// Certificates returns the X.509 certificates contained in the KeyInfo
+// element of the Signature element 'sig'. The certificates are not
+// verified; callers must establish that a certificate is trusted before
+// using its key to verify the signature.
+func Certificates(sig *etree.Element) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	keyInfo := child(sig, "KeyInfo")
+	if keyInfo == nil {
+		return nil, nil
+	}
+	for _, data := range children(keyInfo, "X509Data") {
+		for _, c := range children(data, "X509Certificate") {
+			der, err := decodeBase64(c.Text())
+			if err != nil {
+				return nil, err
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrMalformedSignature, err)
+			}
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+// rootElement returns the root element of the document whose embedded
+// element is d.
+func rootElement(d *etree.Element) *etree.Element {
+	if c := d.ChildElements(); len(c) > 0 {
+		return c[0]
+	}
+	return d
+}
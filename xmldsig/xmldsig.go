@@ -0,0 +1,363 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package xmldsig creates and verifies XML digital signatures (XMLDSig) over
+// etree element trees.
+//
+// A Signer creates enveloped signatures, whose Signature element is added
+// to the signed element, and enveloping signatures, whose Signature element
+// wraps the signed content in an Object element. A Verifier checks the
+// signature value of a Signature element and the digest of each of its
+// references, which are resolved by ID attribute within the signature's
+// document.
+//
+// The following algorithms are supported:
+//
+//	Canonicalization   Canonical XML 1.0 and Exclusive XML Canonicalization
+//	                   1.0, with or without comments
+//	Transforms         Enveloped signature, followed by a canonicalization
+//	Digests            SHA-256, SHA-384 and SHA-512
+//	Signatures         RSA (PKCS #1 v1.5) and ECDSA with SHA-256, SHA-384 or
+//	                   SHA-512
+package xmldsig
+
+import (
+	"crypto"
+	_ "crypto/sha256" // register SHA-256
+	_ "crypto/sha512" // register SHA-384 and SHA-512
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// Namespace is the XML namespace of XML signature elements.
+const Namespace = "http://www.w3.org/2000/09/xmldsig#"
+
+// Canonicalization algorithm identifiers.
+const (
+	C14N10              = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"
+	C14N10WithComments  = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315#WithComments"
+	ExcC14N             = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	ExcC14NWithComments = "http://www.w3.org/2001/10/xml-exc-c14n#WithComments"
+)
+
+// EnvelopedSignature identifies the enveloped signature transform, which
+// removes the Signature element from the signed content.
+const EnvelopedSignature = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+
+// Digest algorithm identifiers.
+const (
+	SHA256 = "http://www.w3.org/2001/04/xmlenc#sha256"
+	SHA384 = "http://www.w3.org/2001/04/xmldsig-more#sha384"
+	SHA512 = "http://www.w3.org/2001/04/xmlenc#sha512"
+)
+
+// Signature algorithm identifiers.
+const (
+	RSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	RSASHA384   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha384"
+	RSASHA512   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	ECDSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	ECDSASHA384 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha384"
+	ECDSASHA512 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512"
+)
+
+var (
+	// ErrMalformedSignature is returned when a Signature element lacks a
+	// required element or contains an invalid value.
+	ErrMalformedSignature = errors.New("xmldsig: malformed signature")
+
+	// ErrUnsupportedAlgorithm is returned when a signature uses an
+	// algorithm, transform or key type this package doesn't support.
+	ErrUnsupportedAlgorithm = errors.New("xmldsig: unsupported algorithm")
+
+	// ErrReferenceNotFound is returned when a signature's reference can't
+	// be resolved to exactly one element.
+	ErrReferenceNotFound = errors.New("xmldsig: reference not found")
+
+	// ErrDigestMismatch is returned when the digest of a referenced
+	// element doesn't match the digest recorded in the signature.
+	ErrDigestMismatch = errors.New("xmldsig: digest mismatch")
+
+	// ErrInvalidSignature is returned when the signature value doesn't
+	// match the signature's SignedInfo element.
+	ErrInvalidSignature = errors.New("xmldsig: invalid signature")
+
+	// ErrSignatureNotFound is returned when a document contains no
+	// Signature element.
+	ErrSignatureNotFound = errors.New("xmldsig: signature not found")
+)
+
+// defaultIDAttributes are the names of the attributes used to resolve
+// references when no other names are provided.
+var defaultIDAttributes = []string{"ID", "Id", "id"}
+
+var digestMethods = map[string]crypto.Hash{
+	SHA256: crypto.SHA256,
+	SHA384: crypto.SHA384,
+	SHA512: crypto.SHA512,
+}
+
+// A signatureMethod describes a signature algorithm.
+type signatureMethod struct {
+	hash  crypto.Hash
+	ecdsa bool
+}
+
+var signatureMethods = map[string]signatureMethod{
+	RSASHA256:   {crypto.SHA256, false},
+	RSASHA384:   {crypto.SHA384, false},
+	RSASHA512:   {crypto.SHA512, false},
+	ECDSASHA256: {crypto.SHA256, true},
+	ECDSASHA384: {crypto.SHA384, true},
+	ECDSASHA512: {crypto.SHA512, true},
+}
+
+// child returns the first child element of e with the specified tag in
+// the XML signature namespace.
+func child(e *etree.Element, tag string) *etree.Element {
+	for _, c := range e.ChildElements() {
+		if c.Tag == tag && c.NamespaceURI() == Namespace {
+			return c
+		}
+	}
+	return nil
+}
+
+// children returns all child elements of e with the specified tag in the
+// XML signature namespace.
+func children(e *etree.Element, tag string) []*etree.Element {
+	var elements []*etree.Element
+	for _, c := range e.ChildElements() {
+		if c.Tag == tag && c.NamespaceURI() == Namespace {
+			elements = append(elements, c)
+		}
+	}
+	return elements
+}
+
+// requireChild returns the first child element of e with the specified
+// tag, or an error if there is none.
+func requireChild(e *etree.Element, tag string) (*etree.Element, error) {
+	if c := child(e, tag); c != nil {
+		return c, nil
+	}
+	return nil, fmt.Errorf("%w: %s has no %s element", ErrMalformedSignature, e.Tag, tag)
+}
+
+// algorithm returns the Algorithm attribute of the child element of e with
+// the specified tag.
+func algorithm(e *etree.Element, tag string) (string, error) {
+	c, err := requireChild(e, tag)
+	if err != nil {
+		return "", err
+	}
+	return c.SelectAttrValue("Algorithm", ""), nil
+}
+
+// c14nSettings returns the canonicalization settings for the method
+// element, which is either a CanonicalizationMethod or a Transform element.
+func c14nSettings(method *etree.Element) (*etree.C14NSettings, error) {
+	s := &etree.C14NSettings{}
+	switch alg := method.SelectAttrValue("Algorithm", ""); alg {
+	case C14N10:
+	case C14N10WithComments:
+		s.WithComments = true
+	case ExcC14N, ExcC14NWithComments:
+		s.Exclusive = true
+		s.WithComments = alg == ExcC14NWithComments
+		for _, c := range method.ChildElements() {
+			if c.Tag == "InclusiveNamespaces" && c.NamespaceURI() == ExcC14N {
+				s.InclusiveNamespaces = strings.Fields(c.SelectAttrValue("PrefixList", ""))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, alg)
+	}
+	return s, nil
+}
+
+// signedInfoDigest canonicalizes the signature's SignedInfo element and
+// returns its digest.
+func signedInfoDigest(signedInfo *etree.Element, hash crypto.Hash) ([]byte, error) {
+	method, err := requireChild(signedInfo, "CanonicalizationMethod")
+	if err != nil {
+		return nil, err
+	}
+	s, err := c14nSettings(method)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(signedInfo.CanonicalBytes(s))
+	return h.Sum(nil), nil
+}
+
+// referenceDigest resolves the Reference element 'ref' of the signature
+// 'sig', applies the reference's transforms and returns the referenced
+// element along with the digest of the transformed data. A reference with
+// an empty URI refers to the whole document containing the signature.
+func referenceDigest(sig, ref *etree.Element, idAttrs []string) (*etree.Element, []byte, error) {
+	alg, err := algorithm(ref, "DigestMethod")
+	if err != nil {
+		return nil, nil, err
+	}
+	hash, ok := digestMethods[alg]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, alg)
+	}
+
+	target, err := resolve(sig, ref.SelectAttrValue("URI", ""), idAttrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := transform(sig, target, child(ref, "Transforms"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h := hash.New()
+	h.Write(data)
+	return target, h.Sum(nil), nil
+}
+
+// resolve returns the element referred to by a same-document reference URI
+// of the signature 'sig'. An empty URI refers to the top of the element
+// tree, which is the document itself if the signature is part of one.
+// Otherwise the URI must be of the form "#id", referring to the single
+// element of the tree having an ID attribute with that value.
+func resolve(sig *etree.Element, uri string, idAttrs []string) (*etree.Element, error) {
+	root := top(sig)
+	if uri == "" {
+		return root, nil
+	}
+
+	id, ok := strings.CutPrefix(uri, "#")
+	if !ok || id == "" {
+		return nil, fmt.Errorf("%w: unsupported reference URI %q", ErrReferenceNotFound, uri)
+	}
+
+	var found []*etree.Element
+	var visit func(e *etree.Element)
+	visit = func(e *etree.Element) {
+		for _, a := range e.Attr {
+			if a.Value == id && isIDAttr(a.Key, idAttrs) {
+				found = append(found, e)
+				break
+			}
+		}
+		for _, c := range e.ChildElements() {
+			visit(c)
+		}
+	}
+	visit(root)
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("%w: no element with ID %q", ErrReferenceNotFound, id)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("%w: more than one element with ID %q", ErrReferenceNotFound, id)
+	}
+}
+
+func isIDAttr(key string, idAttrs []string) bool {
+	for _, k := range idAttrs {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
+
+// transform applies the transforms listed in the Transforms element to the
+// referenced element 'target' and returns the resulting octets. A chain
+// consists of an optional enveloped signature transform followed by an
+// optional canonicalization, which defaults to Canonical XML 1.0. Comments
+// are always omitted, since same-document references exclude them.
+func transform(sig, target, transforms *etree.Element) ([]byte, error) {
+	s := &etree.C14NSettings{}
+	enveloped, canonicalized := false, false
+	if transforms != nil {
+		for _, t := range transforms.ChildElements() {
+			if t.Tag != "Transform" || t.NamespaceURI() != Namespace {
+				return nil, fmt.Errorf("%w: unexpected %s element in Transforms", ErrMalformedSignature, t.Tag)
+			}
+			alg := t.SelectAttrValue("Algorithm", "")
+			if canonicalized {
+				return nil, fmt.Errorf("%w: %s after canonicalization", ErrUnsupportedAlgorithm, alg)
+			}
+			if alg == EnvelopedSignature {
+				enveloped = true
+				continue
+			}
+			var err error
+			if s, err = c14nSettings(t); err != nil {
+				return nil, err
+			}
+			canonicalized = true
+		}
+	}
+	s.WithComments = false
+
+	// Remove the signature from a copy of the element tree.
+	if enveloped && contains(target, sig) {
+		root := top(sig)
+		copied := root.Copy()
+		sigCopy := locate(root, sig, copied)
+		sigCopy.Parent().RemoveChild(sigCopy)
+		target = locate(root, target, copied)
+	}
+	return target.CanonicalBytes(s), nil
+}
+
+// top returns the element at the top of the element tree containing e.
+func top(e *etree.Element) *etree.Element {
+	for e.Parent() != nil {
+		e = e.Parent()
+	}
+	return e
+}
+
+// contains returns true if the element e is an ancestor of the element d.
+func contains(e, d *etree.Element) bool {
+	for d = d.Parent(); d != nil; d = d.Parent() {
+		if d == e {
+			return true
+		}
+	}
+	return false
+}
+
+// locate returns the element of the copied tree 'copied' that corresponds
+// to the element e of the original tree 'root'.
+func locate(root, e, copied *etree.Element) *etree.Element {
+	var indexes []int
+	for ; e != root; e = e.Parent() {
+		indexes = append(indexes, e.Index())
+	}
+	for i := len(indexes) - 1; i >= 0; i-- {
+		copied = copied.Child[indexes[i]].(*etree.Element)
+	}
+	return copied
+}
+
+// isDocument returns true if the element e is a document's embedded
+// element.
+func isDocument(e *etree.Element) bool {
+	return e.Parent() == nil && e.Tag == ""
+}
+
+// decodeBase64 decodes base64 text, ignoring any whitespace it contains.
+func decodeBase64(s string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedSignature, err)
+	}
+	return b, nil
+}
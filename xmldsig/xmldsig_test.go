@@ -0,0 +1,284 @@
+// Copyright 2015-2019 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmldsig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+var rsaKey, ecdsaKey = func() (*rsa.PrivateKey, *ecdsa.PrivateKey) {
+	r, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	e, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return r, e
+}()
+
+var samlXML = `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="r1">` +
+	`<saml:Issuer xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">idp</saml:Issuer>` +
+	`<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="a1">` +
+	`<saml:Subject>alice</saml:Subject>` +
+	`<!-- comments are not signed -->` +
+	`</saml:Assertion>` +
+	`</samlp:Response>`
+
+// reparse serializes the document and reads it back.
+func reparse(t *testing.T, doc *etree.Document) *etree.Document {
+	t.Helper()
+	s, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc = etree.NewDocument()
+	if err := doc.ReadFromString(s); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestSignEnveloped(t *testing.T) {
+	signers := []*Signer{
+		{Key: rsaKey},
+		{Key: ecdsaKey, Hash: crypto.SHA512, Canonicalization: C14N10, Prefix: "dsig"},
+	}
+	for _, signer := range signers {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromString(samlXML); err != nil {
+			t.Fatal(err)
+		}
+		assertion := doc.FindElement("//Assertion")
+		if _, err := signer.SignEnveloped(assertion); err != nil {
+			t.Fatal(err)
+		}
+
+		doc = reparse(t, doc)
+		v := &Verifier{Key: signer.Key.Public()}
+		signed, err := v.VerifyDocument(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(signed) != 1 || signed[0] != doc.FindElement("//Assertion") {
+			t.Fatalf("xmldsig: unexpected signed elements %v", signed)
+		}
+
+		// The signature covers neither comments nor the signature's
+		// position within the signed element.
+		assertion = doc.FindElement("//Assertion")
+		sig := assertion.SelectElement("Signature")
+		assertion.InsertChildAt(0, sig)
+		assertion.RemoveChild(assertion.Child[2].(*etree.Comment))
+		if _, err := v.Verify(sig); err != nil {
+			t.Error(err)
+		}
+
+		doc.FindElement("//Subject").SetText("mallory")
+		if _, err := v.Verify(sig); !errors.Is(err, ErrDigestMismatch) {
+			t.Errorf("xmldsig: expected digest mismatch, got %v", err)
+		}
+	}
+}
+
+func TestSignEnvelopedDocument(t *testing.T) {
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0"`)
+	doc.CreateElement("config").CreateElement("value").SetText("42")
+
+	signer := &Signer{Key: ecdsaKey}
+	if _, err := signer.SignEnveloped(doc.FindElement("config/value")); err == nil {
+		t.Error("xmldsig: expected an error signing an element without an ID")
+	}
+	sig, err := signer.SignEnveloped(doc.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri := sig.FindElement("SignedInfo/Reference").SelectAttrValue("URI", "-"); uri != "" {
+		t.Errorf("xmldsig: unexpected reference URI %q", uri)
+	}
+
+	doc = reparse(t, doc)
+	signed, err := (&Verifier{Key: &ecdsaKey.PublicKey}).VerifyDocument(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signed) != 1 || signed[0] != doc.Root() {
+		t.Errorf("xmldsig: unexpected signed elements %v", signed)
+	}
+}
+
+func TestSignEnveloping(t *testing.T) {
+	content := etree.NewElement("Order")
+	content.CreateAttr("xmlns", "urn:orders")
+	content.CreateElement("Item").SetText("widget")
+
+	sig, err := (&Signer{Key: rsaKey}).SignEnveloping(content, "order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := etree.NewDocumentWithRoot(sig)
+
+	doc = reparse(t, doc)
+	signed, err := (&Verifier{Key: &rsaKey.PublicKey}).Verify(doc.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signed) != 1 || signed[0].Tag != "Object" || signed[0].SelectElement("Order") == nil {
+		t.Errorf("xmldsig: unexpected signed elements %v", signed)
+	}
+
+	// The Object element is identified by the signer's ID attribute.
+	sig, err = (&Signer{Key: rsaKey, IDAttributes: []string{"ref"}}).SignEnveloping(etree.NewElement("Order"), "order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := sig.SelectElement("Object").SelectAttrValue("ref", ""); v != "order" {
+		t.Errorf("xmldsig: unexpected Object ref attribute %q", v)
+	}
+	doc = reparse(t, etree.NewDocumentWithRoot(sig))
+	if _, err := (&Verifier{Key: &rsaKey.PublicKey, IDAttributes: []string{"ref"}}).Verify(doc.Root()); err != nil {
+		t.Error(err)
+	}
+
+	// The content is left in place if signing fails.
+	parent := etree.NewElement("Orders")
+	parent.CreateElement("First")
+	content = parent.CreateElement("Order")
+	parent.CreateElement("Last")
+	if _, err := (&Signer{Key: failingSigner{rsaKey}}).SignEnveloping(content, "order"); err == nil {
+		t.Fatal("xmldsig: expected signing to fail")
+	}
+	if content.Parent() != parent || content.Index() != 1 || len(parent.ChildElements()) != 3 {
+		t.Error("xmldsig: content was not restored to its parent")
+	}
+}
+
+// failingSigner is a crypto.Signer whose Sign function always fails.
+type failingSigner struct {
+	crypto.Signer
+}
+
+func (failingSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return nil, errors.New("sign failed")
+}
+
+func TestVerifyErrors(t *testing.T) {
+	newSigned := func() (*etree.Document, *etree.Element) {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromString(samlXML); err != nil {
+			t.Fatal(err)
+		}
+		sig, err := (&Signer{Key: rsaKey}).SignEnveloped(doc.FindElement("//Assertion"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return doc, sig
+	}
+	v := &Verifier{Key: &rsaKey.PublicKey}
+
+	cases := []struct {
+		name   string
+		modify func(doc *etree.Document, sig *etree.Element) *Verifier
+		err    error
+	}{
+		{"wrong key", func(doc *etree.Document, sig *etree.Element) *Verifier {
+			return &Verifier{Key: &ecdsaKey.PublicKey}
+		}, ErrInvalidSignature},
+		{"modified signed info", func(doc *etree.Document, sig *etree.Element) *Verifier {
+			sig.FindElement("SignedInfo/Reference").CreateAttr("URI", "#r1")
+			return v
+		}, ErrInvalidSignature},
+		{"wrapped assertion", func(doc *etree.Document, sig *etree.Element) *Verifier {
+			evil := doc.FindElement("//Assertion").Copy()
+			evil.RemoveChild(evil.SelectElement("Signature"))
+			doc.Root().AddChild(evil)
+			return v
+		}, ErrReferenceNotFound},
+		{"removed ID", func(doc *etree.Document, sig *etree.Element) *Verifier {
+			doc.FindElement("//Assertion").RemoveAttr("ID")
+			return v
+		}, ErrReferenceNotFound},
+		{"missing signature value", func(doc *etree.Document, sig *etree.Element) *Verifier {
+			sig.RemoveChild(sig.SelectElement("SignatureValue"))
+			return v
+		}, ErrMalformedSignature},
+		{"unsupported transform", func(doc *etree.Document, sig *etree.Element) *Verifier {
+			sig.FindElement("SignedInfo/Reference/Transforms/Transform").CreateAttr("Algorithm", "urn:xpath")
+			return v
+		}, ErrInvalidSignature},
+	}
+	for _, c := range cases {
+		doc, sig := newSigned()
+		v := c.modify(doc, sig)
+		if _, err := v.VerifyDocument(doc); !errors.Is(err, c.err) {
+			t.Errorf("xmldsig: %s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	if _, err := v.VerifyDocument(etree.NewDocument()); err != ErrSignatureNotFound {
+		t.Errorf("xmldsig: expected %v, got %v", ErrSignatureNotFound, err)
+	}
+}
+
+func TestUnsupportedTransform(t *testing.T) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(samlXML); err != nil {
+		t.Fatal(err)
+	}
+	signer := &Signer{Key: rsaKey}
+	sig, err := signer.newSignature("#a1", "urn:xpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.Root().AddChild(sig)
+	if err := signer.sign(sig); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("xmldsig: expected %v, got %v", ErrUnsupportedAlgorithm, err)
+	}
+}
+
+func TestCertificates(t *testing.T) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "signer"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &ecdsaKey.PublicKey, ecdsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := etree.NewElement("Document")
+	sig, err := (&Signer{Key: ecdsaKey, Certificates: [][]byte{der}}).SignEnveloped(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := Certificates(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !bytes.Equal(certs[0].Raw, der) {
+		t.Fatal("xmldsig: unexpected certificates")
+	}
+	if _, err := (&Verifier{Key: certs[0].PublicKey}).Verify(sig); err != nil {
+		t.Error(err)
+	}
+}